@@ -0,0 +1,618 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const cliUsage = `Usage: ultupdater <command> [options]
+
+Commands:
+  install    Install or resume an install without opening the window
+  verify     Check downloaded files on disk, marking missing or damaged ones to be downloaded again
+  seed       Copy files still to be downloaded from another local copy of the install
+  failures   List files which failed to download and why
+
+Run 'ultupdater <command> -h' for command options.
+`
+
+// runCli runs the updater without a window and returns the process exit code
+func runCli(args []string) int {
+	switch args[0] {
+	case "install":
+		return cliInstall(args[1:])
+	case "verify":
+		return cliVerify(args[1:])
+	case "seed":
+		return cliSeed(args[1:])
+	case "failures":
+		return cliFailures(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(cliUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", args[0])
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+}
+
+// cliListener prints downloader events to the terminal
+type cliListener struct {
+	verbose      bool
+	progress     DownloadProgress
+	speed        float64
+	workers      int // Files downloading at once, only set when adaptive
+	quotaReached *QuotaReached
+	diskFull     error
+	mu           sync.Mutex
+}
+
+func (l *cliListener) HandleDownloadEvent(event DownloadEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch e := event.(type) {
+	case *FileDoneEvent:
+		l.progress = e.Progress
+		if l.verbose {
+			fmt.Printf("Done: %s\n", e.File.Filepath)
+		}
+	case *FileRetryEvent:
+		if l.verbose {
+			fmt.Printf("Retrying in %s: %s (%s)\n", e.Delay.Round(100*time.Millisecond), e.File.Filepath, e.Err.Error())
+		}
+	case *FileFailedEvent:
+		l.progress = e.Progress
+		fmt.Fprintf(os.Stderr, "Failed (%s): %s\n%s\n", e.Category, e.File.Filepath, e.Err.Error())
+	case *SpeedEvent:
+		l.speed = e.BytesPerSecond
+	case *ConcurrencyEvent:
+		l.workers = e.Target
+	case *MirrorDisabledEvent:
+		fmt.Printf("Mirror %s is failing, skipping it until %s\n", e.BaseUrl, e.Until.Format("15:04:05"))
+	case *ScheduleEvent:
+		if e.Slot == nil {
+			fmt.Println("Schedule slot ended, using the normal speed limit")
+		} else {
+			fmt.Println(e.Slot.Describe())
+		}
+	case *QuotaReachedEvent:
+		l.quotaReached = e.Err
+		fmt.Printf("%s, stopping...\n", e.Err.Error())
+	case *NetworkEvent:
+		if e.Waiting {
+			fmt.Println("Can't reach the server, waiting for the network to come back...")
+		} else {
+			fmt.Println("Network is back, continuing")
+		}
+	case *DiskFullEvent:
+		l.diskFull = e.Err
+		fmt.Fprintf(os.Stderr, "%s\n", e.Err.Error())
+	case *FinishedEvent:
+		l.progress = e.Progress
+		if e.Progress.Failures > 0 {
+			fmt.Printf("Install finished with %d failures, run again to retry these failed files.\n", e.Progress.Failures)
+		} else {
+			fmt.Println("Install finished with no failures")
+		}
+	case *FatalErrorEvent:
+		fmt.Fprintf(os.Stderr, "Error: %s\n", e.Err.Error())
+	}
+}
+
+func (l *cliListener) printProgress() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	workers := ""
+	if l.workers > 0 {
+		workers = fmt.Sprintf(" | Downloads %d", l.workers)
+	}
+	fmt.Printf("%5.1f%% | %s / %s | Files %s / %s | %s/s | Failures %s%s\n",
+		l.progress.Fraction()*100,
+		FormatBytes(l.progress.DownloadedSize), FormatBytes(l.progress.TotalSize),
+		humanize.Comma(l.progress.DownloadedFiles), humanize.Comma(l.progress.TotalFiles),
+		FormatBytes(int64(l.speed)),
+		humanize.Comma(l.progress.Failures), workers)
+}
+
+// printMirrorStats shows how each mirror is doing, when there's more than one to choose from
+func printMirrorStats(stats []MirrorStats) {
+	if len(stats) < 2 {
+		return
+	}
+	for _, s := range stats {
+		fmt.Printf("  Mirror %s\n", s.String())
+	}
+}
+
+func printCliError(err error) {
+	fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+}
+
+// interruptContext returns a context which is cancelled on interrupt, for stopping long scans early
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		defer signal.Stop(interrupt)
+		select {
+		case <-interrupt:
+			fmt.Println("Interrupted, stopping...")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// runCliSeed copies matching files from seedPath into the install, returning an exit code if the caller should stop
+func runCliSeed(repo *SqliteRepo, installPath string, seedPath string, hardlink bool, workers int, interval time.Duration) (int, bool) {
+	fmt.Printf("Seeding from %s...\n", seedPath)
+	ctx, cancel := interruptContext()
+	defer cancel()
+	lastPrint := time.Now()
+	result, err := seedFiles(ctx, repo, installPath, seedPath, hardlink, workers, func(progress SeedProgress) {
+		if time.Since(lastPrint) >= interval {
+			lastPrint = time.Now()
+			fmt.Printf("%5.1f%% | %s\n", progress.Fraction()*100, progress.String())
+		}
+	})
+	if err != nil {
+		printCliError(err)
+		return 1, true
+	}
+	fmt.Println(result.String())
+	if ctx.Err() != nil {
+		return 130, true
+	}
+	return 0, false
+}
+
+// openCliInstall opens the index of an existing install
+func openCliInstall(installPath string) (string, *SqliteRepo, error) {
+	p, resumable, err := validatePath(installPath)
+	if err != nil {
+		return "", nil, err
+	}
+	if !resumable {
+		return "", nil, fmt.Errorf("no install found at %s", p)
+	}
+	repo, err := OpenDatabase(filepath.Join(p, "ultimate.sqlite"))
+	if err != nil {
+		return "", nil, brokenState(err)
+	}
+	return p, repo, nil
+}
+
+// cliWorkers returns how many files to handle at once, from the -workers flag if given, then config.json, then the default
+func cliWorkers(workers int, config *Config) int {
+	if workers != 0 {
+		return workers
+	}
+	return clampWorkers(config.Workers)
+}
+
+func cliInstall(args []string) int {
+	flags := flag.NewFlagSet("install", flag.ContinueOnError)
+	installPath := flags.String("path", "", "Folder to install into")
+	newInstall := flags.Bool("new", false, "Download the current index even if an install already exists, upgrading it")
+	interval := flags.Duration("interval", 5*time.Second, "How often to print progress")
+	verbose := flags.Bool("verbose", false, "Print every completed and retried file")
+	removeOld := flags.Bool("remove-old", false, "Delete files dropped by an upgrade once the install has finished")
+	workers := flags.Int("workers", 0, fmt.Sprintf("Number of files to download at once, 1 to %d (default from config.json, or %d)", maxWorkers, defaultWorkers))
+	seedPath := flags.String("seed", "", "Copy matching files from another local copy of the install before downloading")
+	hardlink := flags.Bool("hardlink", false, "Hardlink seeded files instead of copying when on the same filesystem")
+	sessionQuota := flags.Float64("session-quota", -1, "Stop after downloading this many GB, 0 for no limit (default from config.json)")
+	monthlyQuota := flags.Float64("monthly-quota", -1, "Stop after downloading this many GB this month, 0 for no limit (default from config.json)")
+	ignoreQuota := flags.Bool("ignore-quota", false, "Keep downloading even if a data quota has been reached")
+	retryFailed := flags.Bool("retry-failed", false, "Only download files which failed last time")
+	adaptive := flags.Bool("adaptive", false, "Tune the number of files downloading at once from the speed and errors (default from config.json)")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if *installPath == "" {
+		fmt.Fprintln(os.Stderr, "Missing required option: -path")
+		flags.Usage()
+		return 2
+	}
+	if *workers < 0 || *workers > maxWorkers {
+		printCliError(&BadWorkerCount{})
+		return 2
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		printCliError(&ConfigError{err})
+		return 1
+	}
+	meta, err := fetchMeta(config.MetaUrl)
+	if err != nil {
+		printCliError(&MetaError{err})
+		return 1
+	}
+
+	workerCount := cliWorkers(*workers, config)
+
+	p, resumable, err := validatePath(*installPath)
+	if err != nil {
+		printCliError(err)
+		return 1
+	}
+	fmt.Printf("Install path: %s\n", p)
+
+	dbPath := filepath.Join(p, "ultimate.sqlite")
+	if !resumable || *newInstall {
+		previousPath, err := stashIndex(p)
+		if err != nil {
+			printCliError(err)
+			return 1
+		}
+
+		fmt.Printf("Downloading index for %s...\n", meta.Current)
+		err = downloadIndex(dbPath, meta.Path, func(float64) {})
+		if err != nil {
+			_ = restoreIndex(p, previousPath)
+			printCliError(&FatalDownloadFailure{err})
+			return 1
+		}
+
+		// Skip files that are unchanged since the previous version
+		if previousPath != "" {
+			fmt.Println("Comparing with previous version...")
+			count, err := carryOverProgress(p, previousPath)
+			if err != nil {
+				printCliError(&DatabaseError{err})
+				return 1
+			}
+			fmt.Printf("%s unchanged files carried over\n", humanize.Comma(count))
+		} else {
+			// Files from an existing install are checked before being downloaded again
+			_, err = prepareAdoptScan(p)
+			if err != nil {
+				printCliError(&DatabaseError{err})
+				return 1
+			}
+		}
+	}
+
+	repo, err := OpenDatabase(dbPath)
+	if err != nil {
+		printCliError(brokenState(err))
+		return 1
+	}
+	defer repo.Close()
+
+	// Finish checking existing files before the totals are loaded, an interrupted check continues next run
+	pending, err := adoptScanPending(repo)
+	if err != nil {
+		printCliError(&DatabaseError{err})
+		return 1
+	}
+	if pending {
+		fmt.Println("Checking existing files...")
+		ctx, cancel := interruptContext()
+		lastPrint := time.Now()
+		result, err := adoptFiles(ctx, repo, p, workerCount, func(progress AdoptProgress) {
+			if time.Since(lastPrint) >= *interval {
+				lastPrint = time.Now()
+				fmt.Printf("%5.1f%% | %s\n", progress.Fraction()*100, progress.String())
+			}
+		})
+		interrupted := ctx.Err() != nil
+		cancel()
+		if err != nil {
+			printCliError(&DatabaseError{err})
+			return 1
+		}
+		fmt.Println(result.String())
+		if interrupted {
+			return 130
+		}
+	}
+
+	if *seedPath != "" {
+		code, stop := runCliSeed(repo, p, *seedPath, *hardlink, workerCount, *interval)
+		if stop {
+			return code
+		}
+	}
+
+	grabber, err := NewDownloader(repo, p)
+	if err != nil {
+		printCliError(&BrokenResumableState{err})
+		return 1
+	}
+	grabber.Workers = workerCount
+	grabber.SegmentThreshold = segmentThreshold(config.SegmentThresholdMB)
+	grabber.Retry = retryPolicy(config.MaxRetries, config.MaxRetryDelaySeconds)
+	grabber.Timeouts = timeoutsFromConfig(config.ConnectTimeoutSeconds, config.TLSTimeoutSeconds, config.IdleTimeoutSeconds)
+	grabber.Adaptive = adaptiveWorkers(config.AdaptiveWorkers || *adaptive, config.MinWorkers, config.MaxWorkers)
+	grabber.AddMirrors(meta.Mirrors)
+
+	overview := grabber.Overview()
+	available := false
+	for _, v := range meta.Available {
+		if v == overview.Name {
+			available = true
+		}
+	}
+	if !available {
+		printCliError(&VersionTooOld{})
+		fmt.Fprintln(os.Stderr, "Run again with -new to upgrade to the current version")
+		return 1
+	}
+	fmt.Printf("Version: %s\n", overview.Name)
+
+	listener := &cliListener{
+		verbose:  *verbose,
+		progress: grabber.Progress(),
+	}
+	grabber.AddListener(listener)
+	grabber.SetSchedule(config.Schedule)
+	if *sessionQuota < 0 {
+		*sessionQuota = config.SessionQuotaGB
+	}
+	if *monthlyQuota < 0 {
+		*monthlyQuota = config.MonthlyQuotaGB
+	}
+	grabber.SetQuota(quotaFromGB(*sessionQuota, *monthlyQuota))
+	if *ignoreQuota {
+		grabber.OverrideQuota()
+	}
+	if *retryFailed {
+		count, err := repo.CountFailures()
+		if err != nil {
+			printCliError(&DatabaseError{err})
+			return 1
+		}
+		fmt.Printf("Retrying %s failed files\n", humanize.Comma(count))
+		err = grabber.RetryFailed()
+	} else {
+		err = grabber.Resume()
+	}
+	if err != nil {
+		var reached *QuotaReached
+		if errors.As(err, &reached) {
+			printCliError(reached)
+			fmt.Fprintln(os.Stderr, "Run again with -ignore-quota to continue anyway")
+			return 3
+		}
+		printCliError(&FatalDownloadFailure{err})
+		return 1
+	}
+
+	// Print progress until the downloader stops, pausing cleanly on interrupt so taken files are released
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	interrupted := false
+	stopped := make(chan struct{})
+	go func() {
+		grabber.Wait()
+		close(stopped)
+	}()
+	t := time.NewTicker(*interval)
+	defer t.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-t.C:
+			listener.printProgress()
+			printMirrorStats(grabber.MirrorStats())
+		case <-interrupt:
+			if !interrupted {
+				interrupted = true
+				fmt.Println("Interrupted, stopping...")
+				go grabber.Stop(false)
+			}
+		case <-stopped:
+			waiting = false
+		}
+	}
+	listener.printProgress()
+	printMirrorStats(grabber.MirrorStats())
+
+	if interrupted {
+		return 130
+	}
+	if listener.quotaReached != nil {
+		fmt.Println("Run again with -ignore-quota to continue anyway")
+		return 3
+	}
+	if listener.diskFull != nil {
+		return 4
+	}
+	progress := grabber.Progress()
+	if progress.Failures > 0 {
+		return 1
+	}
+
+	// Clean up after a finished upgrade
+	if progress.DownloadedFiles == progress.TotalFiles {
+		count, size, err := repo.GetRemovedFilesSummary()
+		if err != nil {
+			printCliError(&DatabaseError{err})
+			return 1
+		}
+		if count > 0 {
+			if *removeOld {
+				removed, err := removeDroppedFiles(repo, p)
+				if err != nil {
+					printCliError(err)
+					return 1
+				}
+				fmt.Printf("Removed %s old files\n", humanize.Comma(removed))
+			} else {
+				fmt.Printf("%s files (%s) are no longer part of this version, run again with -remove-old to delete them\n",
+					humanize.Comma(count), FormatBytes(size))
+				if *verbose {
+					paths, err := repo.GetRemovedFiles()
+					if err != nil {
+						printCliError(&DatabaseError{err})
+						return 1
+					}
+					for _, removedPath := range paths {
+						fmt.Println(removedPath)
+					}
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func cliVerify(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	installPath := flags.String("path", "", "Folder of an existing install")
+	workers := flags.Int("workers", 0, fmt.Sprintf("Number of files to check at once, 1 to %d (default from config.json, or %d)", maxWorkers, defaultWorkers))
+	interval := flags.Duration("interval", 5*time.Second, "How often to print progress")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if *installPath == "" {
+		fmt.Fprintln(os.Stderr, "Missing required option: -path")
+		flags.Usage()
+		return 2
+	}
+	if *workers < 0 || *workers > maxWorkers {
+		printCliError(&BadWorkerCount{})
+		return 2
+	}
+	config, err := loadConfig()
+	if err != nil {
+		printCliError(&ConfigError{err})
+		return 1
+	}
+
+	p, repo, err := openCliInstall(*installPath)
+	if err != nil {
+		printCliError(err)
+		return 1
+	}
+	defer repo.Close()
+	fmt.Printf("Verifying files in %s...\n", p)
+
+	// Stop early on interrupt, anything found so far is still requeued
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	lastPrint := time.Now()
+	result, err := verifyFiles(ctx, repo, p, cliWorkers(*workers, config), func(progress VerifyProgress) {
+		if time.Since(lastPrint) >= *interval {
+			lastPrint = time.Now()
+			fmt.Printf("%5.1f%% | %s\n", progress.Fraction()*100, progress.String())
+		}
+	})
+	if err != nil {
+		printCliError(&DatabaseError{err})
+		return 1
+	}
+	fmt.Println(result.String())
+	if ctx.Err() != nil {
+		return 130
+	}
+
+	if result.Missing+result.Corrupt+result.Unreadable > 0 {
+		if result.Missing+result.Corrupt > 0 {
+			fmt.Println("Run install to download missing and damaged files again")
+		}
+		return 1
+	}
+	return 0
+}
+
+func cliSeed(args []string) int {
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	installPath := flags.String("path", "", "Folder of an existing install")
+	seedPath := flags.String("from", "", "Folder of another copy of the install to copy files from")
+	hardlink := flags.Bool("hardlink", false, "Hardlink files instead of copying when on the same filesystem")
+	workers := flags.Int("workers", 0, fmt.Sprintf("Number of files to check at once, 1 to %d (default from config.json, or %d)", maxWorkers, defaultWorkers))
+	interval := flags.Duration("interval", 5*time.Second, "How often to print progress")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if *installPath == "" || *seedPath == "" {
+		fmt.Fprintln(os.Stderr, "Missing required options: -path and -from")
+		flags.Usage()
+		return 2
+	}
+	if *workers < 0 || *workers > maxWorkers {
+		printCliError(&BadWorkerCount{})
+		return 2
+	}
+	config, err := loadConfig()
+	if err != nil {
+		printCliError(&ConfigError{err})
+		return 1
+	}
+
+	p, repo, err := openCliInstall(*installPath)
+	if err != nil {
+		printCliError(err)
+		return 1
+	}
+	defer repo.Close()
+
+	code, stop := runCliSeed(repo, p, *seedPath, *hardlink, cliWorkers(*workers, config), *interval)
+	if stop {
+		return code
+	}
+	remaining, err := repo.CountFilesAfter(false, 0)
+	if err != nil {
+		printCliError(&DatabaseError{err})
+		return 1
+	}
+	if remaining > 0 {
+		fmt.Printf("%s files are left to download, run install to fetch them\n", humanize.Comma(remaining))
+	}
+	return 0
+}
+
+func cliFailures(args []string) int {
+	flags := flag.NewFlagSet("failures", flag.ContinueOnError)
+	installPath := flags.String("path", "", "Folder of an existing install")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if *installPath == "" {
+		fmt.Fprintln(os.Stderr, "Missing required option: -path")
+		flags.Usage()
+		return 2
+	}
+
+	_, repo, err := openCliInstall(*installPath)
+	if err != nil {
+		printCliError(err)
+		return 1
+	}
+	defer repo.Close()
+
+	failures, err := repo.GetFailures()
+	if err != nil {
+		printCliError(&DatabaseError{err})
+		return 1
+	}
+	if len(failures) == 0 {
+		fmt.Println("No files have failed to download")
+		return 0
+	}
+	for _, f := range failures {
+		fmt.Println(f.String())
+		fmt.Printf("  %s\n", strings.ReplaceAll(f.Error, "\n", "\n  "))
+	}
+	fmt.Printf("%s files failed, run install with -retry-failed to download only these again\n", humanize.Comma(int64(len(failures))))
+	return 0
+}
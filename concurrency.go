@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMinWorkers = 1
+	defaultMaxWorkers = 8
+	// adaptInterval is how often the adaptive download count is reconsidered, long enough for the last change to
+	// show in the average speed
+	adaptInterval = 5 * time.Second
+	// adaptErrorRate is the share of finished transfers which can fail before the server is considered overloaded
+	adaptErrorRate = 0.1
+	// adaptSpeedDrop is how far the average speed can fall before adding downloads is considered to have hurt it
+	adaptSpeedDrop = 0.8
+	// adaptRateCapped is how close to the speed limit counts as already using all of it
+	adaptRateCapped = 0.9
+)
+
+// AdaptiveWorkers tunes how many files download at once from the speed and error rate, staying within Min and Max
+type AdaptiveWorkers struct {
+	Enabled bool
+	Min     int
+	Max     int
+}
+
+// adaptiveWorkers creates the adaptive bounds from config, using the defaults for 0 and keeping Min below Max
+func adaptiveWorkers(enabled bool, min int, max int) AdaptiveWorkers {
+	a := AdaptiveWorkers{
+		Enabled: enabled,
+		Min:     min,
+		Max:     max,
+	}
+	if a.Min <= 0 {
+		a.Min = defaultMinWorkers
+	}
+	if a.Max <= 0 {
+		a.Max = defaultMaxWorkers
+	}
+	a.Min = clampWorkers(a.Min)
+	a.Max = clampWorkers(a.Max)
+	if a.Min > a.Max {
+		a.Min = a.Max
+	}
+	return a
+}
+
+// Clamp keeps a download count within the bounds
+func (a AdaptiveWorkers) Clamp(n int) int {
+	if n < a.Min {
+		return a.Min
+	}
+	if n > a.Max {
+		return a.Max
+	}
+	return n
+}
+
+// Describe returns the current download count for display
+func (a AdaptiveWorkers) Describe(target int) string {
+	if !a.Enabled {
+		return fmt.Sprintf("%d", target)
+	}
+	return fmt.Sprintf("%d (adaptive, %d to %d)", target, a.Min, a.Max)
+}
+
+// concurrencyGate limits how many workers can transfer at once, so the limit can change without restarting them
+type concurrencyGate struct {
+	limit   int
+	active  int
+	changed chan struct{} // Closed when a slot frees or the limit changes, waking anything waiting
+	mu      sync.Mutex
+}
+
+func newConcurrencyGate(limit int) *concurrencyGate {
+	return &concurrencyGate{
+		limit:   limit,
+		changed: make(chan struct{}),
+	}
+}
+
+// Acquire waits for a free slot. Once ctx is done it returns straight away, so workers can drain their queue.
+func (g *concurrencyGate) Acquire(ctx context.Context) {
+	for {
+		g.mu.Lock()
+		if g.active < g.limit || ctx.Err() != nil {
+			g.active += 1
+			g.mu.Unlock()
+			return
+		}
+		changed := g.changed
+		g.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+		case <-changed:
+		}
+	}
+}
+
+// Release frees a slot taken by Acquire
+func (g *concurrencyGate) Release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active -= 1
+	g.notify()
+}
+
+// SetLimit changes how many slots there are. Transfers over a lowered limit finish, but no more start until below it.
+func (g *concurrencyGate) SetLimit(limit int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.limit = limit
+	g.notify()
+}
+
+// notify wakes anything waiting for a slot, must be called with the lock held
+func (g *concurrencyGate) notify() {
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// concurrencyTuner picks how many files to download at once, AIMD style. Each interval adds a download while the
+// speed holds up, and cuts back sharply when too many transfers fail or the speed falls.
+type concurrencyTuner struct {
+	bounds     AdaptiveWorkers
+	target     int
+	lastSpeed  float64
+	lastAdjust time.Time
+	succeeded  int
+	failed     int
+	mu         sync.Mutex
+}
+
+func newConcurrencyTuner(bounds AdaptiveWorkers, start int) *concurrencyTuner {
+	return &concurrencyTuner{
+		bounds:     bounds,
+		target:     bounds.Clamp(start),
+		lastAdjust: time.Now(),
+	}
+}
+
+// Target returns the current number of files to download at once
+func (t *concurrencyTuner) Target() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.target
+}
+
+// Result counts a finished transfer towards the error rate
+func (t *concurrencyTuner) Result(ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ok {
+		t.succeeded += 1
+	} else {
+		t.failed += 1
+	}
+}
+
+// Adjust takes the latest average speed, returning the new target and true if it changed. Nothing changes while
+// held, such as when paused or waiting for the network, and no downloads are added when capped by the speed limit.
+func (t *concurrencyTuner) Adjust(speed float64, held bool, capped bool, now time.Time) (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if held {
+		// Start measuring again once transfers continue
+		t.lastSpeed = 0
+		t.succeeded = 0
+		t.failed = 0
+		t.lastAdjust = now
+		return t.target, false
+	}
+	if now.Sub(t.lastAdjust) < adaptInterval {
+		return t.target, false
+	}
+
+	last := t.target
+	finished := t.succeeded + t.failed
+	switch {
+	case t.failed > 0 && float64(t.failed) > float64(finished)*adaptErrorRate:
+		t.target = t.bounds.Clamp(t.target / 2)
+	case t.lastSpeed > 0 && speed < t.lastSpeed*adaptSpeedDrop:
+		t.target = t.bounds.Clamp(t.target * 3 / 4)
+	case !capped:
+		t.target = t.bounds.Clamp(t.target + 1)
+	}
+	t.lastSpeed = speed
+	t.succeeded = 0
+	t.failed = 0
+	t.lastAdjust = now
+	return t.target, t.target != last
+}
+
+// adaptConcurrency feeds the average speed into the tuner, changing how many files download at once if needed
+func (d *Downloader) adaptConcurrency(speed float64, now time.Time) {
+	if d.tuner == nil {
+		return
+	}
+	held := d.limiter.Paused() || d.network.Waiting()
+	rate := d.limiter.Rate()
+	capped := rate > 0 && speed >= float64(rate)*adaptRateCapped
+	target, changed := d.tuner.Adjust(speed, held, capped, now)
+	if changed {
+		d.gate.SetLimit(target)
+		d.emit(&ConcurrencyEvent{Target: target})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyTunerStaysWithinBounds(t *testing.T) {
+	bounds := adaptiveWorkers(true, 2, 6)
+	tuner := newConcurrencyTuner(bounds, 10)
+	if tuner.Target() != 6 {
+		t.Fatalf("started at %d, want it clamped to 6", tuner.Target())
+	}
+	now := time.Now()
+	// adjust reports the results of one interval then moves past it
+	adjust := func(speed float64, succeeded int, failed int) int {
+		for i := 0; i < succeeded; i++ {
+			tuner.Result(true)
+		}
+		for i := 0; i < failed; i++ {
+			tuner.Result(false)
+		}
+		now = now.Add(adaptInterval)
+		target, _ := tuner.Adjust(speed, false, false, now)
+		return target
+	}
+
+	tests := []struct {
+		name      string
+		speed     float64
+		succeeded int
+		failed    int
+		want      int
+	}{
+		{"no more than max", 1000, 10, 0, 6},
+		{"halved on errors", 1000, 5, 5, 3},
+		{"no less than min", 1000, 5, 5, 2},
+		{"still min on errors", 1000, 0, 3, 2},
+		{"few errors tolerated", 1000, 19, 1, 3},
+		{"recovers one at a time", 1000, 10, 0, 4},
+		{"keeps recovering", 1000, 10, 0, 5},
+		{"recovers to max", 1000, 10, 0, 6},
+		{"stays at max", 1000, 10, 0, 6},
+		{"cut back on a speed drop", 500, 10, 0, 4},
+	}
+	for _, test := range tests {
+		if got := adjust(test.speed, test.succeeded, test.failed); got != test.want {
+			t.Errorf("%s: target %d, want %d", test.name, got, test.want)
+		}
+	}
+
+	// Nothing changes while held, when capped by the speed limit, or before the interval is up
+	tuner.Result(false)
+	now = now.Add(adaptInterval)
+	if target, changed := tuner.Adjust(1000, true, false, now); changed || target != 4 {
+		t.Errorf("held: target %d changed %t, want 4 unchanged", target, changed)
+	}
+	now = now.Add(adaptInterval)
+	if target, changed := tuner.Adjust(1000, false, true, now); changed || target != 4 {
+		t.Errorf("capped: target %d changed %t, want 4 unchanged", target, changed)
+	}
+	tuner.Result(false)
+	if target, changed := tuner.Adjust(1000, false, false, now.Add(time.Second)); changed || target != 4 {
+		t.Errorf("too soon: target %d changed %t, want 4 unchanged", target, changed)
+	}
+}
+
+func TestConcurrencyGateSetLimitWakesWaiters(t *testing.T) {
+	g := newConcurrencyGate(1)
+	g.Acquire(context.Background())
+	acquired := make(chan struct{})
+	go func() {
+		g.Acquire(context.Background())
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired past the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	g.SetLimit(2)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("raising the limit didn't wake the waiting worker")
+	}
+	g.Release()
+	g.Release()
+}
@@ -4,10 +4,9 @@ import (
 	"context"
 	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"fyne.io/fyne/v2/dialog"
 	"github.com/cavaliergopher/grab/v3"
-	"github.com/dustin/go-humanize"
 	"hash/crc32"
 	"os"
 	"path/filepath"
@@ -18,6 +17,10 @@ import (
 type Update struct {
 	IndexFile       *IndexedFile
 	Retry           bool
+	RetryDelay      time.Duration // Wait before retrying, 0 to retry straight away on another mirror
+	Pause           bool          // Stop the downloader after removing the taken flag, such as when the disk is full
+	WaitForNetwork  bool          // Retry once the network is back, without counting a retry
+	Requeue         bool          // Queue again straight away without counting a retry, such as to download it whole
 	RemoveTakenFlag bool
 	Failure         error
 	Progress        float64
@@ -26,70 +29,362 @@ type Update struct {
 }
 
 type Downloader struct {
-	RateLimit    int
-	bufferSize   int
-	state        *InstallerState
-	ctx          context.Context
-	cancel       context.CancelFunc
-	client       *grab.Client
-	reqch        chan *grab.Request
-	respch       chan *grab.Response
-	updatech     chan *Update
-	workerWg     sync.WaitGroup
-	responderWg  sync.WaitGroup
-	updaterWg    sync.WaitGroup
-	newRequestWg sync.WaitGroup
-	running      bool
-	started      bool
-	installPath  string
+	Workers          int   // Files downloaded at once, applied on the next Resume
+	SegmentThreshold int64 // Files at least this large are downloaded in parallel ranges, 0 to disable
+	Retry            RetryPolicy
+	Timeouts         Timeouts        // Applied on the next Resume
+	Adaptive         AdaptiveWorkers // Tune the files downloaded at once from Workers, applied on the next Resume
+	workers          int
+	gate             *concurrencyGate
+	tuner            *concurrencyTuner // Nil unless adaptive
+	bufferSize       int
+	repo             *SqliteRepo
+	overview         IndexOverview
+	progress         DownloadProgress
+	progressMu       sync.Mutex
+	listeners        []DownloadListener
+	listenerMu       sync.Mutex
+	ctx              context.Context
+	cancel           context.CancelFunc
+	client           *grab.Client
+	limiter          *RateLimiter
+	mirrors          *MirrorSet
+	network          *networkBreaker
+	baseRate         int
+	schedule         []ScheduleSlot
+	activeSlot       *ScheduleSlot
+	scheduleMu       sync.Mutex
+	quota            Quota
+	quotaOverride    bool
+	sessionBytes     int64
+	monthBytes       int64
+	month            string
+	lastQuotaSave    time.Time
+	quotaMu          sync.Mutex
+	queue            *fileQueue
+	reqch            chan *grab.Request
+	respch           chan *grab.Response
+	updatech         chan *Update
+	workerWg         sync.WaitGroup
+	responderWg      sync.WaitGroup
+	updaterWg        sync.WaitGroup
+	newRequestWg     sync.WaitGroup
+	running          bool
+	started          bool
+	stopped          chan struct{}
+	lifecycleMu      sync.Mutex
+	installPath      string
 }
 
-func NewDownloader(state *InstallerState) *Downloader {
+// NewDownloader creates a downloader for the install at installPath, loading its current progress from the repo
+func NewDownloader(repo *SqliteRepo, installPath string) (*Downloader, error) {
+	overview, err := repo.GetOverview()
+	if err != nil {
+		return nil, err
+	}
+	// Files finished just before a crash may not have been marked done yet
+	err = recoverJournal(repo, installPath)
+	if err != nil {
+		return nil, err
+	}
+	downloadedSize, err := repo.GetTotalDownloadedSize()
+	if err != nil {
+		return nil, err
+	}
+	downloadedFiles, err := repo.GetTotalDownladedFiles()
+	if err != nil {
+		return nil, err
+	}
+	// The index base url is always the first choice, unless a mirror is given a lower priority
+	mirrors, err := repo.GetMirrors()
+	if err != nil {
+		return nil, err
+	}
+	mirrors = append([]Mirror{{BaseUrl: overview.BaseUrl, Priority: 0}}, mirrors...)
+
 	d := &Downloader{
-		RateLimit:    0,
-		bufferSize:   32 * 1024,
-		state:        state,
+		Workers:          defaultWorkers,
+		SegmentThreshold: defaultSegmentThreshold,
+		Retry:            retryPolicy(0, 0),
+		Timeouts:         timeoutsFromConfig(0, 0, 0),
+		Adaptive:         adaptiveWorkers(false, 0, 0),
+		bufferSize:       32 * 1024,
+		repo:             repo,
+		overview:         overview,
+		progress: DownloadProgress{
+			TotalFiles:      overview.TotalFiles,
+			TotalSize:       overview.TotalSize,
+			DownloadedFiles: downloadedFiles,
+			DownloadedSize:  downloadedSize,
+		},
 		client:       grab.NewClient(),
+		limiter:      NewRateLimiter(0),
+		mirrors:      NewMirrorSet(mirrors),
+		network:      newNetworkBreaker(),
 		workerWg:     sync.WaitGroup{},
 		responderWg:  sync.WaitGroup{},
 		updaterWg:    sync.WaitGroup{},
 		newRequestWg: sync.WaitGroup{},
 		running:      false,
 		started:      false,
+		installPath:  installPath,
 	}
+	err = d.loadDataUsage(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// AddListener subscribes a listener to all future events
+func (d *Downloader) AddListener(listener DownloadListener) {
+	d.listenerMu.Lock()
+	defer d.listenerMu.Unlock()
+	d.listeners = append(d.listeners, listener)
+}
 
-	return d
+func (d *Downloader) emit(event DownloadEvent) {
+	d.listenerMu.Lock()
+	defer d.listenerMu.Unlock()
+	for _, l := range d.listeners {
+		l.HandleDownloadEvent(event)
+	}
+}
+
+// Overview returns the overview of the index being installed
+func (d *Downloader) Overview() IndexOverview {
+	return d.overview
+}
+
+// Progress returns a snapshot of the current install totals
+func (d *Downloader) Progress() DownloadProgress {
+	d.progressMu.Lock()
+	defer d.progressMu.Unlock()
+	return d.progress
+}
+
+func (d *Downloader) updateProgress(f func(p *DownloadProgress)) DownloadProgress {
+	d.progressMu.Lock()
+	defer d.progressMu.Unlock()
+	f(&d.progress)
+	return d.progress
+}
+
+// AddMirrors adds base urls to download from as well as those in the index, such as those listed in meta.json
+func (d *Downloader) AddMirrors(mirrors []Mirror) {
+	d.mirrors.Add(mirrors)
+}
+
+// MirrorStats returns how each mirror has been performing, in priority order
+func (d *Downloader) MirrorStats() []MirrorStats {
+	return d.mirrors.Stats()
+}
+
+// probeMirrors requests the start of a file from every mirror at once, recording how quickly each responded
+func (d *Downloader) probeMirrors(ctx context.Context) {
+	path, err := d.repo.GetProbeFile()
+	if err != nil {
+		if err != sql.ErrNoRows {
+			d.emit(&FatalErrorEvent{&DatabaseError{err}})
+		}
+		return
+	}
+	wg := sync.WaitGroup{}
+	for _, baseUrl := range d.mirrors.BaseUrls() {
+		wg.Add(1)
+		go func(baseUrl string) {
+			defer wg.Done()
+			latency, speed, err := probeMirror(ctx, baseUrl, path)
+			if err != nil {
+				if ctx.Err() == nil && d.mirrors.ReportFailure(baseUrl) {
+					d.emit(&MirrorDisabledEvent{BaseUrl: baseUrl, Until: time.Now().Add(mirrorDisableTime)})
+				}
+				return
+			}
+			d.mirrors.ReportProbe(baseUrl, latency, speed)
+		}(baseUrl)
+	}
+	wg.Wait()
+}
+
+// SetRateLimit changes the total download speed limit in bytes per second, or removes it if 0.
+// Applies straight away to any transfers in progress, unless a schedule slot is overriding it.
+func (d *Downloader) SetRateLimit(bytesPerSecond int) {
+	d.scheduleMu.Lock()
+	d.baseRate = bytesPerSecond
+	d.scheduleMu.Unlock()
+	d.applySchedule(time.Now())
+}
+
+// RateLimit returns the speed limit set outside of any schedule in bytes per second, or 0 if unlimited
+func (d *Downloader) RateLimit() int {
+	d.scheduleMu.Lock()
+	defer d.scheduleMu.Unlock()
+	return d.baseRate
+}
+
+// SetSchedule replaces the times of day when the speed limit is overridden
+func (d *Downloader) SetSchedule(slots []ScheduleSlot) {
+	d.scheduleMu.Lock()
+	d.schedule = slots
+	d.scheduleMu.Unlock()
+	d.applySchedule(time.Now())
+}
+
+// applySchedule sets the limiter for the schedule slot at the given time, announcing when the slot changes
+func (d *Downloader) applySchedule(now time.Time) {
+	d.scheduleMu.Lock()
+	slot := activeScheduleSlot(d.schedule, now)
+	rate := d.baseRate
+	paused := false
+	if slot != nil {
+		rate = slot.Limit * 1024
+		paused = slot.Pause
+	}
+	d.limiter.SetRate(rate)
+	d.limiter.SetPaused(paused)
+
+	changed := (slot == nil) != (d.activeSlot == nil) || (slot != nil && *slot != *d.activeSlot)
+	if slot != nil {
+		copied := *slot
+		slot = &copied
+	}
+	d.activeSlot = slot
+	d.scheduleMu.Unlock()
+
+	if changed {
+		d.emit(&ScheduleEvent{Slot: slot})
+	}
+}
+
+// ActiveScheduleSlot returns the schedule slot currently overriding the speed limit, or nil if none
+func (d *Downloader) ActiveScheduleSlot() *ScheduleSlot {
+	d.scheduleMu.Lock()
+	defer d.scheduleMu.Unlock()
+	return d.activeSlot
+}
+
+// ReloadProgress reads the install totals from the repo again, after files have been marked done or not elsewhere
+func (d *Downloader) ReloadProgress() error {
+	d.lifecycleMu.Lock()
+	defer d.lifecycleMu.Unlock()
+	if d.running {
+		return errors.New("cannot reload progress while running")
+	}
+	downloadedSize, err := d.repo.GetTotalDownloadedSize()
+	if err != nil {
+		return err
+	}
+	downloadedFiles, err := d.repo.GetTotalDownladedFiles()
+	if err != nil {
+		return err
+	}
+	d.updateProgress(func(p *DownloadProgress) {
+		p.DownloadedFiles = downloadedFiles
+		p.DownloadedSize = downloadedSize
+	})
+	return nil
+}
+
+// ResetDownloadState marks every file as not downloaded, so all files are checked again on the next Resume
+func (d *Downloader) ResetDownloadState() error {
+	d.lifecycleMu.Lock()
+	defer d.lifecycleMu.Unlock()
+	if d.running {
+		return errors.New("cannot reset download state while running")
+	}
+	err := d.repo.ResetDownloadState()
+	if err != nil {
+		return err
+	}
+	d.updateProgress(func(p *DownloadProgress) {
+		p.DownloadedFiles = 0
+		p.DownloadedSize = 0
+	})
+	return nil
 }
 
 func (d *Downloader) Resume() error {
+	return d.resume(false)
+}
+
+// RetryFailed starts downloading only the files recorded as failed, stopping first if already running
+func (d *Downloader) RetryFailed() error {
+	d.Stop(false)
+	return d.resume(true)
+}
+
+func (d *Downloader) resume(failedOnly bool) error {
+	d.lifecycleMu.Lock()
+	defer d.lifecycleMu.Unlock()
 	if d.running {
 		return nil
 	}
-	installPath, err := d.state.folderPath.Get()
+
+	// Don't start again until the user chooses to go past a reached quota
+	if reached := d.checkQuota(); reached != nil {
+		return reached
+	}
+
+	// Unfinished downloads from last time are resumed, unless their file isn't wanted anymore
+	err := cleanPartials(d.repo, d.installPath)
+	if err != nil {
+		return err
+	}
+
+	// Files this run has to get through before it's finished
+	queued, err := d.repo.CountQueuedFiles(failedOnly)
 	if err != nil {
 		return err
 	}
-	d.installPath = installPath
 
 	// Reset context
 	d.ctx, d.cancel = context.WithCancel(context.Background())
+	// Try the network again straight away, anything waiting for it was released when stopped
+	d.network.Success()
 
 	// Reset failure count
-	d.state.downloadFailures = 0
-	_ = d.state.formatDownloadFailures.Set("0")
-
-	// Set up background
-	d.reqch = make(chan *grab.Request, 10)
-	d.respch = make(chan *grab.Response, 4)
-	d.updatech = make(chan *Update, 4)
-
-	// Add 4 workers
-	for i := 0; i < 4; i++ {
+	d.updateProgress(func(p *DownloadProgress) {
+		p.Failures = 0
+	})
+
+	// Set up background, keeping a couple of requests queued for each worker
+	d.client.HTTPClient = newHTTPClient(d.Timeouts)
+	d.workers = clampWorkers(d.Workers)
+	d.gate = newConcurrencyGate(d.workers)
+	d.tuner = nil
+	if d.Adaptive.Enabled {
+		// Start a worker for the most files allowed at once, the gate keeps the rest waiting
+		d.tuner = newConcurrencyTuner(d.Adaptive, d.workers)
+		d.gate = newConcurrencyGate(d.tuner.Target())
+		d.workers = d.Adaptive.Max
+		d.emit(&ConcurrencyEvent{Target: d.tuner.Target()})
+	}
+	batchSize := d.workers*2 + 2
+	d.reqch = make(chan *grab.Request, batchSize)
+	d.respch = make(chan *grab.Response, d.workers)
+	d.updatech = make(chan *Update, d.workers)
+	d.queue = newFileQueue(d.repo, failedOnly)
+
+	// Add workers, each holding a slot in the gate until its transfer finishes. Segmented downloads take their
+	// slots from the same gate, so there are never more connections than the current limit.
+	for i := 0; i < d.workers; i++ {
 		d.workerWg.Add(1)
-		go func() {
+		go func(ctx context.Context) {
 			defer d.workerWg.Done()
-			d.client.DoChannel(d.reqch, d.respch)
-		}()
+			for {
+				req, ok := <-d.reqch
+				if !ok {
+					return
+				}
+				d.gate.Acquire(ctx)
+				resp := d.client.Do(req)
+				d.respch <- resp
+				<-resp.Done
+				d.gate.Release()
+			}
+		}(d.ctx)
 	}
 
 	// Add a receiver for responses
@@ -103,6 +398,10 @@ func (d *Downloader) Resume() error {
 				t := time.NewTicker(500 * time.Millisecond)
 				defer t.Stop()
 
+				d.emit(&FileStartedEvent{File: resp.Request.Tag.(*IndexedFile)})
+
+				watch := newStallWatch()
+				stalled := false
 				for {
 					select {
 					case <-t.C:
@@ -114,50 +413,64 @@ func (d *Downloader) Resume() error {
 							Bytes:     resp.BytesComplete(),
 							Done:      false,
 						}
+						// Cancel a transfer which has stopped receiving anything, it's retried below
+						if !stalled && watch.Stalled(resp.BytesComplete(), d.limiter.Paused(), d.stallTimeout()) {
+							stalled = true
+							f.cancel()
+						}
 					case <-resp.Done:
 						// Done, check for error
 						f := resp.Request.Tag.(*IndexedFile)
-						err := resp.Err()
+						f.cancel()
+						err := checkServerBusy(resp.Err(), resp.HTTPResponse)
+						if stalled && err != nil && d.ctx.Err() == nil {
+							err = ErrStalled
+						}
+						if !errors.Is(err, context.Canceled) {
+							d.reportNetwork(err)
+						}
 						if err != nil {
-							fmt.Println(err.Error())
-							if err.Error() == "context canceled" {
-								d.updatech <- &Update{
-									IndexFile:       f,
-									Retry:           false,
-									RemoveTakenFlag: true,
-									Failure:         nil,
-									Progress:        1,
-									Bytes:           0,
-									Done:            true,
-								}
+							if errors.Is(err, context.Canceled) {
+								d.releaseFile(f)
 								return
+							} else if classifyError(err).Local() || (classifyError(err).Network() && d.network.Waiting()) {
+								// Nothing to do with the mirror
+								f.triedMirrors = nil
+								d.retryOrFail(f, err)
 							} else {
-								// Bad download, retry if below 5 retries
-								if f.RetryCount < 5 {
-									f.RetryCount += 1
+								// Try another mirror first, only counting a retry once every mirror has failed
+								if d.mirrors.ReportFailure(f.mirror) {
+									d.emit(&MirrorDisabledEvent{BaseUrl: f.mirror, Until: time.Now().Add(mirrorDisableTime)})
+								}
+								f.triedMirrors = append(f.triedMirrors, f.mirror)
+								if d.mirrors.CanFailover(f.triedMirrors) {
 									d.updatech <- &Update{
 										IndexFile:       f,
 										Retry:           true,
 										RemoveTakenFlag: false,
-										Failure:         nil,
-										Progress:        1,
-										Bytes:           0,
-										Done:            true,
-									}
-								} else {
-									d.updatech <- &Update{
-										IndexFile:       f,
-										Retry:           false,
-										RemoveTakenFlag: false,
 										Failure:         err,
 										Progress:        1,
 										Bytes:           0,
 										Done:            true,
 									}
+									return
 								}
+								f.triedMirrors = nil
+								d.retryOrFail(f, err)
 							}
 						} else {
-							// Successful download, notify UI updater
+							// Successful download, notify updater
+							// Resumed transfers would overstate the mirror's throughput
+							measured := resp.BytesComplete()
+							if resp.DidResume {
+								measured = 0
+							}
+							d.mirrors.ReportSuccess(f.mirror, measured, resp.Duration())
+							err = finishPartial(d.installPath, f)
+							if err != nil {
+								d.retryOrFail(f, err)
+								return
+							}
 							d.updatech <- &Update{
 								IndexFile:       f,
 								Retry:           false,
@@ -177,6 +490,41 @@ func (d *Downloader) Resume() error {
 		d.responderWg.Done()
 	}()
 
+	// Follow the schedule while running
+	d.applySchedule(time.Now())
+	d.responderWg.Add(1)
+	go func() {
+		defer d.responderWg.Done()
+		t := time.NewTicker(5 * time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-d.ctx.Done():
+				return
+			case now := <-t.C:
+				d.applySchedule(now)
+			}
+		}
+	}()
+
+	// Rank mirrors now and every so often while running
+	if d.mirrors.Len() > 1 {
+		d.responderWg.Add(1)
+		go func() {
+			defer d.responderWg.Done()
+			t := time.NewTicker(mirrorProbeInterval)
+			defer t.Stop()
+			for {
+				d.probeMirrors(d.ctx)
+				select {
+				case <-d.ctx.Done():
+					return
+				case <-t.C:
+				}
+			}
+		}()
+	}
+
 	// Set up empty dirs handler
 
 	// Attach to any wait group, it's independent anyway
@@ -190,48 +538,67 @@ func (d *Downloader) Resume() error {
 				return
 			default:
 				// Get next empty dir
-				dir, err := d.state.Repo.GetNextEmptyDir()
+				dir, err := d.repo.GetNextEmptyDir()
 				if err != nil {
 					if err != sql.ErrNoRows {
-						dialog.NewError(&DatabaseError{err}, d.state.window).Show()
-						return
+						d.emit(&FatalErrorEvent{&DatabaseError{err}})
 					}
+					return
 				}
 				dest := filepath.Join(d.installPath, dir)
 				err = os.MkdirAll(dest, os.ModePerm)
 				if err != nil {
 					// Illegal folder on windows?
-					dialog.NewError(&FatalDownloadFailure{err}, d.state.window).Show()
+					d.emit(&FatalErrorEvent{&FatalDownloadFailure{err}})
 					return
 				}
 			}
 		}
 	}()
 
-	// Set up UI updater
+	// Set up updater
 	d.updaterWg.Add(1)
 	go func() {
 		defer d.updaterWg.Done()
 
-		// Create UI files
-		uifiles := make([]*UiFile, 4)
-		for i := 0; i < 4; i++ {
-			uifiles[i] = &UiFile{
-				Filepath: "",
-				Progress: 0,
-				Done:     true,
+		// Bytes received when the speed handler and quota were last updated
+		lastTotal := d.limiter.Total()
+		quotaReached := false
+		diskFull := false
+		// Files finished or failed this run
+		processed := int64(0)
+		// Finished files are marked done in batches
+		journal := newDoneJournal(d.repo, d.installPath)
+		defer func() {
+			// Count anything received since the last update, the limiter sees every byte including retries
+			_, err := d.addDataUsage(d.limiter.Total()-lastTotal, time.Now())
+			if err == nil {
+				err = d.saveDataUsage()
 			}
-		}
+			if err != nil {
+				d.emit(&FatalErrorEvent{&DatabaseError{err}})
+			}
+			err = journal.Close()
+			if err != nil {
+				d.emit(&FatalErrorEvent{&DatabaseError{err}})
+			}
+			// Give back every file taken this run which didn't finish
+			d.queue.Wait()
+			err = d.repo.ClearTakenAll()
+			if err != nil {
+				d.emit(&FatalErrorEvent{&DatabaseError{err}})
+			}
+		}()
 
 		// Create speed handler
-		speedch := make(chan int64, 4)
+		speedch := make(chan int64, d.workers)
 		defer close(speedch)
 		// Set up download speed handler to store records and update average
 		d.updaterWg.Add(1)
 		go func() {
 			defer d.updaterWg.Done()
-			// Set UI speed value to 0 when downloader stops
-			defer func() { _ = d.state.formatDownloadSpeed.Set("0.0B/s") }()
+			// Set speed value to 0 when downloader stops
+			defer d.emit(&SpeedEvent{BytesPerSecond: 0})
 			// Track 6 speed records to get average
 			bytePerSecondRecords := make([]float64, 0)
 
@@ -273,234 +640,207 @@ func (d *Downloader) Resume() error {
 					lastUpdate = curTime
 					// Push record
 					queue(float64(byteDiff) / secondsDiff)
-					// Update UI
-					d.state.downloadSpeed = averageSpeed()
-					_ = d.state.formatDownloadSpeed.Set(FormatBytes(int64(d.state.downloadSpeed)) + "/s")
+					d.emit(&SpeedEvent{BytesPerSecond: averageSpeed()})
+					d.adaptConcurrency(averageSpeed(), curTime)
 				}
 			}
 		}()
 
-		_ = d.state.fileTitle1.Set("None")
-		_ = d.state.fileProgress1.Set(0)
-		_ = d.state.fileTitle2.Set("None")
-		_ = d.state.fileProgress2.Set(0)
-		_ = d.state.fileTitle3.Set("None")
-		_ = d.state.fileProgress3.Set(0)
-		_ = d.state.fileTitle4.Set("None")
-		_ = d.state.fileProgress4.Set(0)
-
 		for update := range d.updatech {
-			// Download failure, maximum retries reached
-			if update.Failure != nil {
-				d.state.downloadFailures += 1
-				_ = d.state.formatDownloadFailures.Set(humanize.Comma(d.state.downloadFailures))
+			// Send bytes received since the last update to speed handler and quota
+			total := d.limiter.Total()
+			speedch <- total - lastTotal
+			reached, err := d.addDataUsage(total-lastTotal, time.Now())
+			lastTotal = total
+			if err != nil {
+				d.emit(&FatalErrorEvent{&DatabaseError{err}})
+			}
+			if journal.Due(time.Now()) {
+				err := journal.Flush()
+				if err != nil {
+					d.emit(&FatalErrorEvent{&DatabaseError{err}})
+				}
+			}
+			if reached != nil && !quotaReached {
+				// Stop cleanly, partial files are resumed later
+				quotaReached = true
+				d.emit(&QuotaReachedEvent{Err: reached})
+				go d.Stop(false)
 			}
 
-			// Failed download because of context cancel, remove taken flag instead, ignore ui update
+			// Failed download because of context cancel, it's given back with the rest when the downloader stops
 			if update.RemoveTakenFlag {
-				err = d.state.Repo.ClearTaken(update.IndexFile)
-				if err != nil {
-					dialog.NewError(&DatabaseError{err}, d.state.window).Show()
+				if update.Pause && !diskFull {
+					// Stop instead of failing every file left, the user can start again once there's space
+					diskFull = true
+					d.emit(&DiskFullEvent{Err: update.Failure})
+					go d.Stop(false)
 				}
 				continue
 			}
 
-			// Immediately retry file if asked, ignore ui update
+			// Retry file after waiting if asked
 			if update.Retry {
+				if !update.WaitForNetwork && !update.Requeue {
+					d.emit(&FileRetryEvent{File: update.IndexFile, Err: update.Failure, Delay: update.RetryDelay})
+					if d.tuner != nil {
+						d.tuner.Result(false)
+					}
+				}
+				f := update.IndexFile
 				d.newRequestWg.Add(1)
+				delay := update.RetryDelay
+				var restored <-chan struct{}
+				if update.WaitForNetwork {
+					restored = d.network.Restored()
+				}
 				go func() {
 					defer d.newRequestWg.Done()
-					time.Sleep(time.Second * 1) // Retry after 3 seconds
+					if delay > 0 || restored != nil {
+						var timeout <-chan time.Time
+						if delay > 0 {
+							t := time.NewTimer(delay)
+							defer t.Stop()
+							timeout = t.C
+						}
+						select {
+						case <-d.ctx.Done():
+							// Given back when the downloader stops, so it's picked up again when resumed
+							return
+						case <-restored:
+						case <-timeout:
+						}
+					}
 					select {
 					case <-d.ctx.Done():
 						{
-							// Kill request channel since we are sole sender
-							close(d.reqch)
+							// Context dead, Stop will close the request channel
 							return
 						}
 					default:
 						{
-							req, err := d.NewRequest(update.IndexFile)
-							if err != nil {
-								dialog.NewError(err, d.state.window).Show()
-							}
-							d.reqch <- req
+							d.queueFile(f)
 						}
 					}
 				}()
 				continue
 			}
 
-			// Update UI element
+			if !update.Done {
+				d.emit(&FileProgressEvent{
+					File:     update.IndexFile,
+					Progress: update.Progress,
+					Bytes:    update.Bytes,
+				})
+				continue
+			}
+
+			var progress DownloadProgress
 			if update.Failure == nil {
-				updateIdx := -1
-				for idx, f := range uifiles {
-					if f.Filepath == update.IndexFile.Filepath {
-						// Send bytes update to speed handler
-						bytesDiff := update.Bytes - f.Bytes
-						speedch <- bytesDiff
-						// Update ui file
-						f.Progress = update.Progress
-						f.Done = update.Done
-						f.Bytes = update.Bytes
-						updateIdx = idx
-						break
-					}
+				// Mark as done with the next batch
+				err := journal.Add(update.IndexFile)
+				if err != nil {
+					d.emit(&FatalErrorEvent{&DatabaseError{err}})
 				}
-				if updateIdx == -1 {
-					// Didn't find existing entry, find an older one to replace
-					for idx, f := range uifiles {
-						if f.Done == true {
-							// Send bytes update to speed handler
-							bytesDiff := update.Bytes
-							speedch <- bytesDiff
-							// Update ui file
-							f.Filepath = update.IndexFile.Filepath
-							f.Progress = update.Progress
-							f.Done = update.Done
-							f.Bytes = update.Bytes
-							updateIdx = idx
-							break
-						}
-					}
+				progress = d.updateProgress(func(p *DownloadProgress) {
+					p.DownloadedSize += update.IndexFile.Size
+					p.DownloadedFiles += 1
+				})
+				if d.tuner != nil {
+					d.tuner.Result(true)
 				}
-				// If updated ui state, update element
-				if updateIdx != -1 {
-					if updateIdx == 0 {
-						_ = d.state.fileTitle1.Set(update.IndexFile.Filepath)
-						_ = d.state.fileProgress1.Set(update.Progress)
-					}
-					if updateIdx == 1 {
-						_ = d.state.fileTitle2.Set(update.IndexFile.Filepath)
-						_ = d.state.fileProgress2.Set(update.Progress)
-					}
-					if updateIdx == 2 {
-						_ = d.state.fileTitle3.Set(update.IndexFile.Filepath)
-						_ = d.state.fileProgress3.Set(update.Progress)
-					}
-					if updateIdx == 3 {
-						_ = d.state.fileTitle4.Set(update.IndexFile.Filepath)
-						_ = d.state.fileProgress4.Set(update.Progress)
-					}
+				d.emit(&FileDoneEvent{File: update.IndexFile, Progress: progress})
+			} else {
+				// Download failure, maximum retries reached
+				progress = d.updateProgress(func(p *DownloadProgress) {
+					p.Failures += 1
+				})
+				category := failureCategory(update.Failure)
+				err := d.repo.RecordFailure(update.IndexFile.Filepath, update.Failure.Error(), category.String(),
+					update.IndexFile.RetryCount+1, time.Now())
+				if err != nil {
+					d.emit(&FatalErrorEvent{&DatabaseError{err}})
 				}
+				d.emit(&FileFailedEvent{
+					File:     update.IndexFile,
+					Err:      update.Failure,
+					Category: category,
+					Progress: progress,
+				})
 			}
-
-			if update.Done {
-				if update.Failure == nil {
-					// Mark as done
-					d.state.downloadedSize += update.IndexFile.Size
-					d.state.downloadedFiles += 1
-					err := d.state.Repo.MarkFileDone(update.IndexFile)
-					if err != nil {
-						dialog.NewError(&DatabaseError{err}, d.state.window).Show()
+			processed += 1
+
+			d.newRequestWg.Add(1)
+			go func() {
+				defer d.newRequestWg.Done()
+				select {
+				case <-d.ctx.Done():
+					{
+						// Context dead, assume channel closed already by parent
+						return
 					}
-				}
-
-				d.newRequestWg.Add(1)
-				go func() {
-					defer d.newRequestWg.Done()
-					select {
-					case <-d.ctx.Done():
-						{
-							// Context dead, assume channel closed already by parent
-							return
-						}
-					default:
-						{
-							// Add new request to the queue
-							f, err := d.state.Repo.GetNextFile()
-							if err != nil {
-								if err != sql.ErrNoRows {
-									dialog.NewError(&DatabaseError{err}, d.state.window).Show()
-								}
-							} else {
-								req, err := d.NewRequest(f)
-								if err != nil {
-									// Send failure (bad parsing)
-									d.updatech <- &Update{
-										IndexFile: f,
-										Progress:  0,
-										Bytes:     0,
-										Done:      true,
-										Retry:     false,
-										Failure:   &FatalDownloadFailure{err},
-									}
-								} else {
-									d.reqch <- req
-								}
-							}
+				default:
+					{
+						// Add new request to the queue
+						f, err := d.queue.Next()
+						if err != nil {
+							d.emit(&FatalErrorEvent{&DatabaseError{err}})
+						} else if f != nil {
+							d.queueFile(f)
 						}
 					}
-				}()
-
-				// Update Total Progress bar state
-				err = d.state.formatDownloadedSize.Set(FormatBytes(d.state.downloadedSize))
-				if err != nil {
-					dialog.NewError(err, d.state.window).Show()
 				}
-				err = d.state.formatDownloadedFiles.Set(humanize.Comma(d.state.downloadedFiles))
-				if err != nil {
-					dialog.NewError(err, d.state.window).Show()
+			}()
+
+			// Check if we're done
+			if processed == queued {
+				// Done!
+				err := journal.Flush()
+				if err == nil {
+					err = d.repo.ClearTakenAll()
 				}
-				progress := float64(d.state.downloadedSize) / float64(d.state.totalSize)
-				err = d.state.progressBarTotal.Set(progress)
+				d.cancel()
 				if err != nil {
-					dialog.NewError(err, d.state.window).Show()
-				}
-
-				// Check if we're done
-				totalFiles := d.state.downloadedFiles + d.state.downloadFailures
-				if totalFiles == d.state.totalFiles {
-					// Done!
-					err := d.state.Repo.ClearTakenAll()
-					d.cancel()
-					go func() {
-						d.Stop(true)
-						if err != nil {
-							dialog.NewError(&DatabaseError{err}, d.state.window).Show()
-						} else {
-							if d.state.downloadFailures > 0 {
-								dialog.NewInformation("Finished", fmt.Sprintf("Install finished with %d failures, you will have to press start again to retry these failed files.", d.state.downloadFailures), d.state.window).Show()
-							} else {
-								dialog.NewInformation("Finished", "Install finished with no failures", d.state.window).Show()
-							}
-						}
-					}()
+					d.emit(&FatalErrorEvent{&DatabaseError{err}})
 				}
-
+				// Tidy away folders left by finished downloads, anything missed is tried again on the next Resume
+				_ = cleanPartials(d.repo, d.installPath)
+				d.emit(&FinishedEvent{Progress: progress})
+				go d.Stop(true)
 			}
 		}
 	}()
 
-	// Add initial 10 files
-	files, err := d.state.Repo.GetNextFileBatch(10)
-	if err != nil {
-		return err
-	}
-	for _, f := range files {
-		req, err := d.NewRequest(f)
+	// Add initial files
+	started := 0
+	for started < batchSize {
+		f, err := d.queue.Next()
 		if err != nil {
-			// Send failure (bad parsing)
-			d.updatech <- &Update{
-				IndexFile: f,
-				Progress:  0,
-				Bytes:     0,
-				Done:      true,
-				Retry:     false,
-				Failure:   &FatalDownloadFailure{err},
-			}
-		} else {
-			// Add request to queue
-			d.reqch <- req
+			return err
+		}
+		if f == nil {
+			break
 		}
+		d.queueFile(f)
+		started += 1
 	}
 	d.running = true
-	_ = d.state.runningLabel.Set("Running")
+	d.stopped = make(chan struct{})
+	d.emit(&RunningEvent{Running: true})
+
+	// Nothing left to download, finish straight away
+	if started == 0 {
+		d.cancel()
+		d.emit(&FinishedEvent{Progress: d.Progress()})
+		go d.Stop(true)
+	}
 
 	return nil
 }
 
 func (d *Downloader) Stop(skipCancelContext bool) {
+	d.lifecycleMu.Lock()
+	defer d.lifecycleMu.Unlock()
 	if !d.running {
 		return
 	}
@@ -522,13 +862,132 @@ func (d *Downloader) Stop(skipCancelContext bool) {
 	d.updaterWg.Wait()
 
 	d.running = false
-	_ = d.state.runningLabel.Set("Stopped")
+	close(d.stopped)
+	d.emit(&RunningEvent{Running: false})
+}
+
+// Wait blocks until the downloader is stopped, either by finishing or by a call to Stop
+func (d *Downloader) Wait() {
+	d.lifecycleMu.Lock()
+	stopped := d.stopped
+	d.lifecycleMu.Unlock()
+	if stopped != nil {
+		<-stopped
+	}
+}
+
+// Running reports whether the downloader is currently active
+func (d *Downloader) Running() bool {
+	d.lifecycleMu.Lock()
+	defer d.lifecycleMu.Unlock()
+	return d.running
+}
+
+// queueFile hands a file to the workers, or starts a segmented download if it's large enough
+func (d *Downloader) queueFile(f *IndexedFile) {
+	if d.SegmentThreshold > 0 && f.Size >= d.SegmentThreshold && !f.whole {
+		d.responderWg.Add(1)
+		go func() {
+			defer d.responderWg.Done()
+			d.downloadSegmented(f)
+		}()
+		return
+	}
+
+	req, err := d.NewRequest(f)
+	if err != nil {
+		// Send failure (bad parsing)
+		d.updatech <- &Update{
+			IndexFile: f,
+			Progress:  0,
+			Bytes:     0,
+			Done:      true,
+			Retry:     false,
+			Failure:   &FatalDownloadFailure{err},
+		}
+		return
+	}
+	d.reqch <- req
+}
+
+// releaseFile gives back a file whose download was cancelled, so it's picked up again next time
+func (d *Downloader) releaseFile(f *IndexedFile) {
+	d.updatech <- &Update{
+		IndexFile:       f,
+		Retry:           false,
+		RemoveTakenFlag: true,
+		Failure:         nil,
+		Progress:        1,
+		Bytes:           0,
+		Done:            true,
+	}
+}
+
+// retryOrFail queues a failed file to be tried again, or reports it as failed once out of retries.
+// Permanent errors fail straight away, and a full disk pauses the downloader instead of failing the file.
+func (d *Downloader) retryOrFail(f *IndexedFile, err error) {
+	category := classifyError(err)
+	if category == ErrorDiskFull {
+		d.updatech <- &Update{
+			IndexFile:       f,
+			Retry:           false,
+			RemoveTakenFlag: true,
+			Pause:           true,
+			Failure:         &DiskFull{err},
+			Progress:        1,
+			Bytes:           0,
+			Done:            true,
+		}
+		return
+	}
+
+	// Don't count failures while the network is down, wait for it to come back instead
+	if category.Network() && d.network.Waiting() {
+		d.updatech <- &Update{
+			IndexFile:       f,
+			Retry:           true,
+			WaitForNetwork:  true,
+			RemoveTakenFlag: false,
+			Failure:         err,
+			Progress:        1,
+			Bytes:           0,
+			Done:            true,
+		}
+		return
+	}
+
+	// Bad download, retry with a growing wait until out of retries
+	if !category.Permanent() && f.RetryCount < d.Retry.MaxRetries {
+		f.RetryCount += 1
+		d.updatech <- &Update{
+			IndexFile:       f,
+			Retry:           true,
+			RetryDelay:      d.Retry.RetryAfter(f.RetryCount, err),
+			RemoveTakenFlag: false,
+			Failure:         err,
+			Progress:        1,
+			Bytes:           0,
+			Done:            true,
+		}
+		return
+	}
+	d.updatech <- &Update{
+		IndexFile:       f,
+		Retry:           false,
+		RemoveTakenFlag: false,
+		Failure:         &DownloadFailure{err, f.RetryCount, category},
+		Progress:        1,
+		Bytes:           0,
+		Done:            true,
+	}
 }
 
 func (d *Downloader) NewRequest(f *IndexedFile) (*grab.Request, error) {
 	// Set up request
-	dest := filepath.Join(d.installPath, f.Filepath)
-	req, err := grab.NewRequest(dest, fmt.Sprintf("%s/%s", d.state.baseUrl, f.Filepath))
+	// Downloaded aside and moved into place once the checksum passes
+	dest := partialPath(d.installPath, f.Filepath)
+	f.mirror = d.mirrors.Pick(f.triedMirrors)
+	req, err := grab.NewRequest(dest, fmt.Sprintf("%s/%s", f.mirror, f.Filepath))
 	if err != nil {
 		return nil, err
 	}
@@ -540,11 +999,12 @@ func (d *Downloader) NewRequest(f *IndexedFile) (*grab.Request, error) {
 	}
 	req.SetChecksum(crc32.NewIEEE(), sum, true)
 	req.Size = f.Size
-	req = req.WithContext(d.ctx)
+	// Each request can be cancelled on its own if it stalls
+	ctx, cancel := context.WithCancel(d.ctx)
+	f.cancel = cancel
+	req = req.WithContext(ctx)
 	req.BufferSize = d.bufferSize
-	if d.RateLimit != 0 {
-		req.RateLimiter = &DownloadRateLimiter{rate: d.RateLimit / 4}
-	}
+	req.RateLimiter = d.limiter
 
 	// Add indexed file as tag
 	req.Tag = f
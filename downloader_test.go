@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer serves the given files, answering 404 for anything else. Paths in failOnce get a 500 the first time.
+func testServer(t *testing.T, files map[string][]byte, failOnce ...string) *httptest.Server {
+	t.Helper()
+	failed := make(map[string]bool)
+	mu := sync.Mutex{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/")
+		mu.Lock()
+		fail := containsString(failOnce, path) && !failed[path]
+		failed[path] = true
+		mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		data, ok := files[path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, path, time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// runDownloader downloads everything queued in repo into installPath, returning the progress it finished with.
+// Each configure is called on the downloader before it starts.
+func runDownloader(t *testing.T, repo *SqliteRepo, installPath string, configure ...func(d *Downloader)) DownloadProgress {
+	t.Helper()
+	d, err := NewDownloader(repo, installPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Retry = retryPolicy(1, 1)
+	for _, c := range configure {
+		c(d)
+	}
+	var finished *FinishedEvent
+	d.AddListener(DownloadListenerFunc(func(event DownloadEvent) {
+		switch e := event.(type) {
+		case *FinishedEvent:
+			finished = e
+		case *FatalErrorEvent:
+			t.Errorf("fatal error: %v", e.Err)
+		}
+	}))
+	err = d.Resume()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		d.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		d.Stop(false)
+		t.Fatal("downloader didn't finish")
+	}
+	if finished == nil {
+		t.Fatal("stopped without finishing")
+	}
+	return finished.Progress
+}
+
+func TestDownloaderFinishesWithRetriesAndFailures(t *testing.T) {
+	contents := map[string][]byte{
+		"Data/a.bin":     []byte("first file"),
+		"Data/b.bin":     []byte("second file, fails once"),
+		"Data/sub/c.bin": []byte("third file"),
+	}
+	files := []*IndexedFile{
+		testFile("Data/a.bin", contents["Data/a.bin"]),
+		testFile("Data/b.bin", contents["Data/b.bin"]),
+		testFile("Data/sub/c.bin", contents["Data/sub/c.bin"]),
+		testFile("Data/missing.bin", []byte("not on the server")),
+	}
+	server := testServer(t, contents, "Data/b.bin")
+	repo := openTestIndex(t, server.URL, files...)
+	installPath := t.TempDir()
+
+	progress := runDownloader(t, repo, installPath)
+	if progress.DownloadedFiles != 3 || progress.Failures != 1 {
+		t.Errorf("finished with %d downloaded and %d failed, want 3 and 1", progress.DownloadedFiles, progress.Failures)
+	}
+	for path, data := range contents {
+		got, err := os.ReadFile(filepath.Join(installPath, path))
+		if err != nil {
+			t.Errorf("%s not downloaded: %v", path, err)
+		} else if !bytes.Equal(got, data) {
+			t.Errorf("%s downloaded with the wrong contents", path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(installPath, partialDir)); !os.IsNotExist(err) {
+		t.Errorf("staging folder left behind: %v", err)
+	}
+	if taken := countTaken(t, repo); taken != 0 {
+		t.Errorf("%d files still taken after finishing", taken)
+	}
+	failures, err := repo.GetFailures()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 1 || failures[0].Path != "Data/missing.bin" {
+		t.Errorf("recorded failures %v, want only the missing file", failures)
+	}
+	queued, err := repo.CountQueuedFiles(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued != 1 {
+		t.Errorf("%d files left queued, want the failed one", queued)
+	}
+}
+
+func TestDownloaderGivesBackFilesOnStop(t *testing.T) {
+	files := numberedFiles(50)
+	// Nothing ever arrives, so every transfer is still going when stopped
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	repo := openTestIndex(t, server.URL, files...)
+
+	d, err := NewDownloader(repo, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Resume()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	d.Stop(false)
+
+	if taken := countTaken(t, repo); taken != 0 {
+		t.Errorf("%d files still taken after stopping", taken)
+	}
+	queued, err := repo.CountQueuedFiles(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued != int64(len(files)) {
+		t.Errorf("%d files queued after stopping, want all %d", queued, len(files))
+	}
+	if d.Progress().Failures != 0 {
+		t.Errorf("stopping counted %d failures", d.Progress().Failures)
+	}
+}
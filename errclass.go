@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/cavaliergopher/grab/v3"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"runtime"
+	"syscall"
+)
+
+// ErrorCategory groups download errors by how they should be handled
+type ErrorCategory int
+
+const (
+	// ErrorTransient covers network and server errors likely to clear up on their own, retried with backoff
+	ErrorTransient ErrorCategory = iota
+	// ErrorTimeout is a connection or transfer which took too long, retried with backoff
+	ErrorTimeout
+	// ErrorConnection is a server which couldn't be reached at all, retried with backoff
+	ErrorConnection
+	// ErrorChecksum is a download which didn't match the index, retried in case it was damaged in transit
+	ErrorChecksum
+	// ErrorNotFound is a file the server doesn't have or won't give us, failed straight away
+	ErrorNotFound
+	// ErrorPermission is a file which can't be written locally, failed straight away
+	ErrorPermission
+	// ErrorDiskFull stops the downloader until space is freed, without failing the file
+	ErrorDiskFull
+)
+
+func (c ErrorCategory) String() string {
+	switch c {
+	case ErrorTimeout:
+		return "timeout"
+	case ErrorConnection:
+		return "connection error"
+	case ErrorChecksum:
+		return "checksum mismatch"
+	case ErrorNotFound:
+		return "not found"
+	case ErrorPermission:
+		return "permission denied"
+	case ErrorDiskFull:
+		return "disk full"
+	default:
+		return "network error"
+	}
+}
+
+// Permanent reports whether retrying the same file is pointless
+func (c ErrorCategory) Permanent() bool {
+	return c == ErrorNotFound || c == ErrorPermission
+}
+
+// Network reports whether the error suggests the network is down, rather than a problem with one file
+func (c ErrorCategory) Network() bool {
+	return c == ErrorTimeout || c == ErrorConnection
+}
+
+// Local reports whether the error came from this machine rather than a mirror, so trying another mirror won't help
+func (c ErrorCategory) Local() bool {
+	return c == ErrorPermission || c == ErrorDiskFull
+}
+
+// classifyError works out the category of an error from a download
+func classifyError(err error) ErrorCategory {
+	if isDiskFull(err) {
+		return ErrorDiskFull
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		return ErrorPermission
+	}
+	if errors.Is(err, grab.ErrBadChecksum) {
+		return ErrorChecksum
+	}
+	var status grab.StatusCodeError
+	if errors.As(err, &status) {
+		switch int(status) {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return ErrorTransient
+		}
+		if status >= 400 && status < 500 {
+			return ErrorNotFound
+		}
+		return ErrorTransient
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrStalled) {
+		return ErrorTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorTimeout
+	}
+	if isConnectionError(err) {
+		return ErrorConnection
+	}
+	return ErrorTransient
+}
+
+// failureCategory returns the category recorded with a failure, classifying it if it wasn't
+func failureCategory(err error) ErrorCategory {
+	var failure *DownloadFailure
+	if errors.As(err, &failure) {
+		return failure.category
+	}
+	return classifyError(err)
+}
+
+func isDiskFull(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	if errno == syscall.ENOSPC {
+		return true
+	}
+	// ERROR_HANDLE_DISK_FULL and ERROR_DISK_FULL
+	return runtime.GOOS == "windows" && (errno == 39 || errno == 112)
+}
+
+// isConnectionError reports whether a request failed to reach the server or lost its connection
+func isConnectionError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cavaliergopher/grab/v3"
+	"io"
+	"io/fs"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorCategory
+	}{
+		{"disk full", &fs.PathError{Op: "write", Path: "f", Err: syscall.ENOSPC}, ErrorDiskFull},
+		{"permission", &fs.PathError{Op: "open", Path: "f", Err: fs.ErrPermission}, ErrorPermission},
+		{"checksum", grab.ErrBadChecksum, ErrorChecksum},
+		{"not found", grab.StatusCodeError(404), ErrorNotFound},
+		{"forbidden", grab.StatusCodeError(403), ErrorNotFound},
+		{"request timeout", grab.StatusCodeError(408), ErrorTransient},
+		{"too many requests", grab.StatusCodeError(429), ErrorTransient},
+		{"server error", grab.StatusCodeError(500), ErrorTransient},
+		{"busy", &ServerBusy{err: grab.StatusCodeError(503)}, ErrorTransient},
+		{"deadline", context.DeadlineExceeded, ErrorTimeout},
+		{"stalled", fmt.Errorf("reading body: %w", ErrStalled), ErrorTimeout},
+		{"dns", &net.DNSError{Err: "no such host", Name: "example.com"}, ErrorConnection},
+		{"refused", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, ErrorConnection},
+		{"reset", syscall.ECONNRESET, ErrorConnection},
+		{"cut off", io.ErrUnexpectedEOF, ErrorConnection},
+		{"no range support", ErrNoRangeSupport, ErrorTransient},
+		{"unknown", errors.New("something else"), ErrorTransient},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := classifyError(test.err)
+			if got != test.want {
+				t.Errorf("classifyError(%v) = %s, want %s", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFailureCategory(t *testing.T) {
+	// The category is kept from when the file failed, rather than worked out again from the wrapped error
+	err := &DownloadFailure{grab.ErrBadChecksum, 5, ErrorTimeout}
+	if got := failureCategory(err); got != ErrorTimeout {
+		t.Errorf("failureCategory = %s, want %s", got, ErrorTimeout)
+	}
+	if got := failureCategory(grab.StatusCodeError(404)); got != ErrorNotFound {
+		t.Errorf("failureCategory = %s, want %s", got, ErrorNotFound)
+	}
+}
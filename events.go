@@ -0,0 +1,124 @@
+package main
+
+import (
+	"time"
+)
+
+// DownloadEvent is published by the Downloader to every attached DownloadListener.
+// Listeners should switch on the concrete event type and ignore any they do not handle.
+type DownloadEvent interface{}
+
+// DownloadListener receives events from a Downloader. Events are delivered one at a time,
+// but may come from any goroutine, so listeners must not call back into the Downloader directly.
+type DownloadListener interface {
+	HandleDownloadEvent(event DownloadEvent)
+}
+
+// DownloadListenerFunc allows an ordinary function to be used as a DownloadListener
+type DownloadListenerFunc func(event DownloadEvent)
+
+func (f DownloadListenerFunc) HandleDownloadEvent(event DownloadEvent) {
+	f(event)
+}
+
+// DownloadProgress is a snapshot of the install totals
+type DownloadProgress struct {
+	TotalFiles      int64
+	TotalSize       int64
+	DownloadedFiles int64
+	DownloadedSize  int64
+	Failures        int64
+}
+
+// Fraction returns how much of the install size has been downloaded, between 0 and 1
+func (p DownloadProgress) Fraction() float64 {
+	if p.TotalSize == 0 {
+		return 0
+	}
+	return float64(p.DownloadedSize) / float64(p.TotalSize)
+}
+
+// RunningEvent is sent when the downloader starts or stops
+type RunningEvent struct {
+	Running bool
+}
+
+// FileStartedEvent is sent when a transfer for a file begins
+type FileStartedEvent struct {
+	File *IndexedFile
+}
+
+// FileProgressEvent is sent periodically while a file is transferring
+type FileProgressEvent struct {
+	File     *IndexedFile
+	Progress float64
+	Bytes    int64
+}
+
+// FileDoneEvent is sent when a file has been downloaded and verified
+type FileDoneEvent struct {
+	File     *IndexedFile
+	Progress DownloadProgress
+}
+
+// FileRetryEvent is sent when a file failed to download and has been queued again
+type FileRetryEvent struct {
+	File  *IndexedFile
+	Err   error
+	Delay time.Duration
+}
+
+// FileFailedEvent is sent when a file has run out of retries
+type FileFailedEvent struct {
+	File     *IndexedFile
+	Err      error
+	Category ErrorCategory
+	Progress DownloadProgress
+}
+
+// SpeedEvent is sent whenever the average download speed is recalculated
+type SpeedEvent struct {
+	BytesPerSecond float64
+}
+
+// MirrorDisabledEvent is sent when a mirror has failed too many times in a row and will be skipped for a while
+type MirrorDisabledEvent struct {
+	BaseUrl string
+	Until   time.Time
+}
+
+// ScheduleEvent is sent when a schedule slot starts or stops overriding the speed limit. Slot is nil outside any slot.
+type ScheduleEvent struct {
+	Slot *ScheduleSlot
+}
+
+// QuotaReachedEvent is sent when a data quota is reached, the downloader stops straight after
+type QuotaReachedEvent struct {
+	Err *QuotaReached
+}
+
+// NetworkEvent is sent when requests keep failing to connect and files start waiting for the network, and again
+// once it's back
+type NetworkEvent struct {
+	Waiting bool
+}
+
+// DiskFullEvent is sent when a file can't be written because the disk is full, the downloader stops straight after
+type DiskFullEvent struct {
+	Err error
+}
+
+// ConcurrencyEvent is sent when adaptive downloading changes how many files download at once, and when it starts
+type ConcurrencyEvent struct {
+	Target int
+}
+
+// FinishedEvent is sent when every file has either been downloaded or failed
+type FinishedEvent struct {
+	Progress DownloadProgress
+}
+
+// FatalErrorEvent is sent when the downloader hits an error it cannot recover from by itself
+type FatalErrorEvent struct {
+	Err error
+}
@@ -32,7 +32,7 @@ def hash(file, bufsize=2 ** 16):
     return crc32
 
 
-def index(path, name, base_url, db_file):
+def index(path, name, base_url, db_file, mirrors=()):
     # Delete the database file if it already exists
     if os.path.exists(db_file):
         os.remove(db_file)
@@ -44,6 +44,7 @@ def index(path, name, base_url, db_file):
     # Set up database
     insert_empty_dir_query = "INSERT INTO empty_dirs (path) VALUES (?)"
     insert_file_query = "INSERT INTO files (path, size, crc32) VALUES (?, ?, ?)"
+    insert_mirror_query = "INSERT INTO mirrors (base_url, priority) VALUES (?, ?)"
     overview_schema = """
     CREATE TABLE overview (
         name TEXT PRIMARY KEY,
@@ -67,6 +68,12 @@ def index(path, name, base_url, db_file):
         done INTEGER DEFAULT false
     );
     """
+    mirrors_schema = """
+    CREATE TABLE mirrors (
+        base_url TEXT PRIMARY KEY,
+        priority INTEGER
+    );
+    """
     index_statement = """
     CREATE INDEX crc_idx ON files (crc32);
     """
@@ -76,6 +83,7 @@ def index(path, name, base_url, db_file):
     cur.execute(overview_schema)
     cur.execute(dirs_schema)
     cur.execute(files_schema)
+    cur.execute(mirrors_schema)
     cur.execute(index_statement)
     cur.execute(index2_statement)
     conn.commit()
@@ -108,6 +116,8 @@ def index(path, name, base_url, db_file):
     res = cur.fetchone()
     cur.execute("INSERT INTO overview (name, total_size, total_files, base_url) VALUES (?,?,?,?);",
                 (name, res[0], res[1], base_url))
+    # Extra mirrors are tried in the order given, after base_url
+    cur.executemany(insert_mirror_query, ((m, i + 1) for i, m in enumerate(mirrors)))
     conn.commit()
 
     print("Saving Database...")
@@ -120,8 +130,8 @@ def index(path, name, base_url, db_file):
 
 
 if __name__ == '__main__':
-    if len(sys.argv) != 5:
-        print('Usage: index.py <path> <index_name> <base_url> <out.sqlite>')
+    if len(sys.argv) < 5:
+        print('Usage: index.py <path> <index_name> <base_url> <out.sqlite> [mirror_url ...]')
         sys.exit(0)
 
-    index(sys.argv[1], sys.argv[2], sys.argv[3], sys.argv[4])
+    index(sys.argv[1], sys.argv[2], sys.argv[3], sys.argv[4], sys.argv[5:])
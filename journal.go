@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+const (
+	// doneBatchSize is how many finished files are marked done in the repo at once
+	doneBatchSize = 256
+	// doneFlushInterval is the longest a finished file waits before being marked done
+	doneFlushInterval = 2 * time.Second
+	// pendingJournal lists finished files not yet marked done, so they're checked instead of downloaded again after a crash
+	pendingJournal = "ultimate.pending"
+)
+
+// doneJournal marks finished files done in batches, instead of a write to the repo for every file.
+// Each file is appended to a journal as it finishes, so a batch lost to a crash can be found again.
+// Files are synced to disk before being moved into place, and their folders before the batch is committed,
+// so a file is never marked done before it's safely on disk.
+type doneJournal struct {
+	repo        *SqliteRepo
+	installPath string
+	file        *os.File
+	pending     []*IndexedFile
+	lastFlush   time.Time
+}
+
+func newDoneJournal(repo *SqliteRepo, installPath string) *doneJournal {
+	return &doneJournal{
+		repo:        repo,
+		installPath: installPath,
+		pending:     make([]*IndexedFile, 0, doneBatchSize),
+		lastFlush:   time.Now(),
+	}
+}
+
+// Add records a file which has been downloaded and moved into place
+func (j *doneJournal) Add(f *IndexedFile) error {
+	if j.file == nil {
+		file, err := os.OpenFile(filepath.Join(j.installPath, pendingJournal), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		j.file = file
+	}
+	j.pending = append(j.pending, f)
+	_, err := j.file.WriteString(f.Filepath + "\n")
+	return err
+}
+
+// Due reports whether enough files are waiting, or they've waited long enough, to be marked done
+func (j *doneJournal) Due(now time.Time) bool {
+	if len(j.pending) == 0 {
+		return false
+	}
+	return len(j.pending) >= doneBatchSize || now.Sub(j.lastFlush) >= doneFlushInterval
+}
+
+// Flush marks every waiting file done in one transaction, then empties the journal
+func (j *doneJournal) Flush() error {
+	j.lastFlush = time.Now()
+	if len(j.pending) == 0 {
+		return nil
+	}
+
+	// Make sure the renames into place are on disk first
+	err := syncParents(j.installPath, j.pending)
+	if err != nil {
+		return err
+	}
+	err = j.repo.SetFilesDone(j.pending, true)
+	if err != nil {
+		return err
+	}
+	j.pending = j.pending[:0]
+	return j.file.Truncate(0)
+}
+
+// Close flushes any waiting files and removes the journal
+func (j *doneJournal) Close() error {
+	err := j.Flush()
+	if j.file == nil {
+		return err
+	}
+	closeErr := j.file.Close()
+	j.file = nil
+	if err != nil {
+		// Keep the journal so the files are checked next time
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Remove(filepath.Join(j.installPath, pendingJournal))
+}
+
+// recoverJournal checks the files left in the journal by a crash, marking any found complete on disk as done
+func recoverJournal(repo *SqliteRepo, installPath string) error {
+	journalPath := filepath.Join(installPath, pendingJournal)
+	file, err := os.Open(journalPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	found := make([]*IndexedFile, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// The last line may have been cut off, which won't match a file
+		f, err := repo.GetQueuedFile(scanner.Text())
+		if err != nil {
+			return err
+		}
+		if f != nil && checkFile(installPath, f) == FileOk {
+			found = append(found, f)
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return err
+	}
+
+	err = repo.SetFilesDone(found, true)
+	if err != nil {
+		return err
+	}
+	_ = file.Close()
+	return os.Remove(journalPath)
+}
+
+// syncFile flushes a file's contents to disk
+func syncFile(p string) error {
+	return syncOpened(os.OpenFile(p, os.O_RDWR, 0))
+}
+
+// syncDir flushes a folder's entries to disk, such as files renamed into it
+func syncDir(p string) error {
+	return syncOpened(os.Open(p))
+}
+
+// syncParents flushes the folders holding each file, so files moved into them are on disk before being marked done
+func syncParents(installPath string, files []*IndexedFile) error {
+	dirs := make(map[string]bool)
+	for _, f := range files {
+		dirs[path.Dir(f.Filepath)] = true
+	}
+	for dir := range dirs {
+		err := syncDir(filepath.Join(installPath, dir))
+		if err != nil && !isDirSyncUnsupported(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// isDirSyncUnsupported reports whether a folder couldn't be synced because the system doesn't allow it.
+// Windows refuses to flush a folder handle, but renames there are already durable.
+func isDirSyncUnsupported(err error) bool {
+	var errno syscall.Errno
+	if runtime.GOOS != "windows" || !errors.As(err, &errno) {
+		return false
+	}
+	// ERROR_INVALID_FUNCTION, ERROR_ACCESS_DENIED and ERROR_INVALID_HANDLE
+	return errno == 1 || errno == 5 || errno == 6
+}
+
+func syncOpened(file *os.File, err error) error {
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
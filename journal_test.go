@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeInstalled puts a file's contents at its place in the install
+func writeInstalled(t *testing.T, installPath string, path string, data []byte) {
+	t.Helper()
+	p := filepath.Join(installPath, path)
+	err := os.MkdirAll(filepath.Dir(p), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(p, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func isQueued(t *testing.T, repo *SqliteRepo, path string) bool {
+	t.Helper()
+	f, err := repo.GetQueuedFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f != nil
+}
+
+func TestRecoverJournal(t *testing.T) {
+	good := testFile("Data/good.bin", []byte("finished before the crash"))
+	damaged := testFile("Data/damaged.bin", []byte("contents the index expects"))
+	missing := testFile("Data/missing.bin", []byte("never made it to disk"))
+	cutOff := testFile("Data/cut/off.bin", []byte("journal line cut short"))
+	repo := openTestIndex(t, "http://localhost", good, damaged, missing, cutOff)
+	installPath := t.TempDir()
+
+	writeInstalled(t, installPath, good.Filepath, []byte("finished before the crash"))
+	writeInstalled(t, installPath, damaged.Filepath, []byte("something else entirely"))
+	writeInstalled(t, installPath, cutOff.Filepath, []byte("journal line cut short"))
+	// The last line was being written when the crash happened
+	journal := good.Filepath + "\n" + damaged.Filepath + "\n" + missing.Filepath + "\n" + "Data/cut/of"
+	err := os.WriteFile(filepath.Join(installPath, pendingJournal), []byte(journal), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = recoverJournal(repo, installPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		file   *IndexedFile
+		queued bool
+	}{
+		{good, false},
+		{damaged, true},
+		{missing, true},
+		{cutOff, true},
+	}
+	for _, test := range tests {
+		if got := isQueued(t, repo, test.file.Filepath); got != test.queued {
+			t.Errorf("%s queued = %t, want %t", test.file.Filepath, got, test.queued)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(installPath, pendingJournal)); !os.IsNotExist(err) {
+		t.Errorf("journal not removed after recovering: %v", err)
+	}
+
+	// Nothing to do without a journal
+	err = recoverJournal(repo, installPath)
+	if err != nil {
+		t.Errorf("recovering without a journal: %v", err)
+	}
+}
+
+func TestDoneJournal(t *testing.T) {
+	files := numberedFiles(3)
+	repo := openTestIndex(t, "http://localhost", files...)
+	installPath := t.TempDir()
+	for _, f := range files {
+		writeInstalled(t, installPath, f.Filepath, []byte("placeholder"))
+	}
+	journalPath := filepath.Join(installPath, pendingJournal)
+
+	j := newDoneJournal(repo, installPath)
+	for _, f := range files[:2] {
+		err := j.Add(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Listed in the journal, but not marked done until flushed
+	data, err := os.ReadFile(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := files[0].Filepath + "\n" + files[1].Filepath + "\n"; string(data) != want {
+		t.Errorf("journal holds %q, want %q", data, want)
+	}
+	if !isQueued(t, repo, files[0].Filepath) {
+		t.Error("marked done before flushing")
+	}
+
+	err = j.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files[:2] {
+		if isQueued(t, repo, f.Filepath) {
+			t.Errorf("%s not marked done after flushing", f.Filepath)
+		}
+	}
+	info, err := os.Stat(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("journal holds %d bytes after flushing, want it emptied", info.Size())
+	}
+
+	err = j.Add(files[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = j.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isQueued(t, repo, files[2].Filepath) {
+		t.Error("closing didn't mark the last file done")
+	}
+	if _, err := os.Stat(journalPath); !os.IsNotExist(err) {
+		t.Errorf("journal not removed after closing: %v", err)
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
@@ -20,11 +22,16 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 )
 
 func main() {
+	// macOS passes a process serial number when launched from Finder, ignore it
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-psn_") {
+		os.Exit(runCli(os.Args[1:]))
+	}
+
 	a := app.New()
 	w := a.NewWindow("Flashpoint Ultimate Updater")
 
@@ -44,17 +51,57 @@ func main() {
 }
 
 func NewInstallState(w fyne.Window) *InstallerState {
+	state := newInstallerState()
+	state.window = w
+	state.App = app.NewWithID("com.flashpointarchive.ultimate-updater")
+
+	// Try and load config
+	var err error
+	state.Config, err = loadConfig()
+	if err != nil {
+		dialog.NewError(&ConfigError{err}, w).Show()
+	} else {
+		// Worker count set in the window takes priority over config.json
+		state.adaptive = adaptiveWorkers(state.Config.AdaptiveWorkers, state.Config.MinWorkers, state.Config.MaxWorkers)
+		setFileSlots(state, clampWorkers(state.App.Preferences().IntWithFallback("workers", state.Config.Workers)))
+		state.schedule = state.Config.Schedule
+		if text := state.App.Preferences().String("schedule"); text != "" {
+			schedule, err := parseSchedule(text)
+			if err == nil {
+				state.schedule = schedule
+			}
+		}
+		state.sessionQuotaGB = state.App.Preferences().FloatWithFallback("session-quota-gb", state.Config.SessionQuotaGB)
+		state.monthlyQuotaGB = state.App.Preferences().FloatWithFallback("monthly-quota-gb", state.Config.MonthlyQuotaGB)
+
+		state.Meta, err = fetchMeta(state.Config.MetaUrl)
+		if err != nil {
+			d := dialog.NewError(&MetaError{err}, w)
+			d.SetOnClosed(func() {
+				state.App.Quit()
+			})
+			d.Show()
+		} else {
+			// Try and load last opened folder
+			lastInstallPath := state.App.Preferences().StringWithFallback("last-install-path", "")
+			if lastInstallPath != "" {
+				p, resumable, err := validatePath(lastInstallPath)
+				if err == nil {
+					loadDatabaseResume(p, resumable, state)
+				}
+				// Ignore any error and pretend the path wasn't set
+			}
+		}
+	}
+
+	return state
+}
+
+// newInstallerState creates a state with default values, without any window or app attached
+func newInstallerState() *InstallerState {
 	state := InstallerState{
-		window:                 w,
-		App:                    app.NewWithID("com.flashpointarchive.ultimate-updater"),
 		folderPath:             binding.NewString(),
 		installName:            binding.NewString(),
-		totalFiles:             0,
-		totalSize:              0,
-		downloadedSize:         0,
-		downloadedFiles:        0,
-		downloadSpeed:          0,
-		downloadFailures:       0,
 		runningLabel:           binding.NewString(),
 		formatDownloadedFiles:  binding.NewString(),
 		formatDownloadedSize:   binding.NewString(),
@@ -63,18 +110,12 @@ func NewInstallState(w fyne.Window) *InstallerState {
 		formatDownloadSpeed:    binding.NewString(),
 		formatDownloadFailures: binding.NewString(),
 		progressBarTotal:       binding.NewFloat(),
-		fileTitle1:             binding.NewString(),
-		fileTitle2:             binding.NewString(),
-		fileTitle3:             binding.NewString(),
-		fileTitle4:             binding.NewString(),
-		fileProgress1:          binding.NewFloat(),
-		fileProgress2:          binding.NewFloat(),
-		fileProgress3:          binding.NewFloat(),
-		fileProgress4:          binding.NewFloat(),
+		formatWorkers:          binding.NewString(),
+		workersEntry:           binding.NewString(),
 		rateLimitEntry:         binding.NewString(),
 		formatRateLimit:        binding.NewString(),
+		formatSchedule:         binding.NewString(),
 		resumable:              false,
-		baseUrl:                "",
 	}
 	_ = state.folderPath.Set("Not Set")
 	_ = state.installName.Set("None")
@@ -84,77 +125,45 @@ func NewInstallState(w fyne.Window) *InstallerState {
 	_ = state.formatTotalSize.Set("0.0B")
 	_ = state.formatDownloadSpeed.Set("0.0B/s")
 	_ = state.progressBarTotal.Set(0)
-	_ = state.fileTitle1.Set("None")
-	_ = state.fileTitle2.Set("None")
-	_ = state.fileTitle3.Set("None")
-	_ = state.fileTitle4.Set("None")
-	_ = state.fileProgress1.Set(0)
-	_ = state.fileProgress2.Set(0)
-	_ = state.fileProgress3.Set(0)
-	_ = state.fileProgress4.Set(0)
+	setFileSlots(&state, defaultWorkers)
 	_ = state.rateLimitEntry.Set("")
 	_ = state.formatRateLimit.Set("Unlimited")
+	_ = state.formatSchedule.Set("")
 	_ = state.runningLabel.Set("Stopped")
 	_ = state.formatDownloadFailures.Set("0")
 
-	// Try and load config
-	err := loadConfig(&state)
-	if err != nil {
-		dialog.NewError(&ConfigError{err}, w).Show()
-	} else {
-		err = func() error {
-			// Load meta.json from remote
-			response, err := http.Get(state.Config.MetaUrl)
-			if err != nil {
-				fmt.Println("Error:", err)
-				return err
-			}
-			defer response.Body.Close()
-
-			// Read the response body into a string
-			bodyBytes, err := io.ReadAll(response.Body)
-			if err != nil {
-				return err
-			}
+	return &state
+}
 
-			var meta Meta
-			decoder := json.NewDecoder(bytes.NewReader(bodyBytes))
-			err = decoder.Decode(&meta)
-			if err != nil {
-				return err
-			}
+func fetchMeta(metaUrl string) (*Meta, error) {
+	// Load meta.json from remote
+	response, err := http.Get(metaUrl)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return nil, err
+	}
+	defer response.Body.Close()
 
-			state.Meta = &meta
-			return nil
-		}()
-		if err != nil {
-			d := dialog.NewError(&MetaError{err}, w)
-			d.SetOnClosed(func() {
-				state.App.Quit()
-			})
-			d.Show()
-		} else {
-			// Try and load last opened folder
-			lastInstallPath := state.App.Preferences().StringWithFallback("last-install-path", "")
-			if lastInstallPath != "" {
-				p, resumable, err := validatePath(lastInstallPath)
-				if err == nil {
-					loadDatabaseResume(p, resumable, &state)
-				}
-				// Ignore any error and pretend the path wasn't set
-			}
-		}
+	// Read the response body into a string
+	bodyBytes, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
 	}
 
-	state.Grabber = NewDownloader(&state)
+	var meta Meta
+	decoder := json.NewDecoder(bytes.NewReader(bodyBytes))
+	err = decoder.Decode(&meta)
+	if err != nil {
+		return nil, err
+	}
 
-	return &state
+	return &meta, nil
 }
 
-func loadConfig(state *InstallerState) error {
+func loadConfig() (*Config, error) {
 	cwd, err := os.Getwd()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	parseConfig := func(content io.Reader) (*Config, error) {
@@ -167,6 +176,10 @@ func loadConfig(state *InstallerState) error {
 		if err != nil {
 			return nil, err
 		}
+		err = validateSchedule(config.Schedule)
+		if err != nil {
+			return nil, err
+		}
 
 		return &config, nil
 	}
@@ -177,33 +190,23 @@ func loadConfig(state *InstallerState) error {
 		// External found, use that
 		file, err := os.Open(configPath)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		defer file.Close()
 
-		config, err := parseConfig(file)
-		if err != nil {
-			return err
-		}
-		state.Config = config
+		return parseConfig(file)
 	} else if os.IsNotExist(err) {
 		// None found, Check internal config
 		reader := bytes.NewReader(resourceConfigJson.StaticContent)
-		config, err := parseConfig(reader)
-		if err != nil {
-			return err
-		}
-		state.Config = config
+		return parseConfig(reader)
 	} else {
-		return err
+		return nil, err
 	}
-
-	return nil
 }
 
 func setupLayout(w fyne.Window, state *InstallerState) *fyne.Container {
 	buttonResume := widget.NewButton("Resume Install", func() {
-		w.SetContent(mainLayout(w, state))
+		openInstallLayout(w, state)
 	})
 	if !state.resumable {
 		buttonResume.Disable()
@@ -226,24 +229,17 @@ func setupLayout(w fyne.Window, state *InstallerState) *fyne.Container {
 				return
 			}
 			state.Repo = nil
+			state.Grabber = nil
 		}
 
-		// Remove current install state
+		// Move current install state aside, it's compared against once the new index is downloaded
 		folderPath, err := state.folderPath.Get()
 		dbPath := filepath.Join(folderPath, "ultimate.sqlite")
 
-		_, err = os.Stat(dbPath)
+		previousPath, err := stashIndex(folderPath)
 		if err != nil {
-			if !os.IsNotExist(err) {
-				dialog.NewError(err, state.window).Show()
-				return
-			}
-		} else {
-			err = os.Remove(dbPath)
-			if err != nil {
-				dialog.NewError(err, state.window).Show()
-				return
-			}
+			dialog.NewError(err, state.window).Show()
+			return
 		}
 
 		// Set up progress screen
@@ -251,8 +247,11 @@ func setupLayout(w fyne.Window, state *InstallerState) *fyne.Container {
 		_ = progressData.Set(0)
 
 		showProgressScreen("Downloading New Index...", state.window, progressData)
-		req, err := grab.NewRequest(dbPath, state.Meta.Path)
+		err = downloadIndex(dbPath, state.Meta.Path, func(progress float64) {
+			_ = progressData.Set(progress)
+		})
 		if err != nil {
+			_ = restoreIndex(folderPath, previousPath)
 			d := dialog.NewError(&FatalDownloadFailure{err}, state.window)
 			d.SetOnClosed(func() {
 				state.App.Quit()
@@ -261,40 +260,24 @@ func setupLayout(w fyne.Window, state *InstallerState) *fyne.Container {
 			return
 		}
 
-		// Download file
-		client := grab.NewClient()
-		res := client.Do(req)
-		wg := sync.WaitGroup{}
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			t := time.NewTicker(100 * time.Millisecond)
-			defer t.Stop()
-			for {
-				select {
-				case <-t.C:
-					_ = progressData.Set(res.Progress())
-				case <-res.Done:
-					return
-				}
+		// Skip files that are unchanged since the previous version
+		if previousPath != "" {
+			openWaitScreen("Comparing With Previous Version...", state.window)
+			_, err = carryOverProgress(folderPath, previousPath)
+			if err != nil {
+				dialog.NewError(&DatabaseError{err}, state.window).Show()
+			}
+		} else {
+			// Files from an existing install are checked before being downloaded again
+			_, err = prepareAdoptScan(folderPath)
+			if err != nil {
+				dialog.NewError(&DatabaseError{err}, state.window).Show()
 			}
-		}()
-		wg.Wait()
-
-		// Check for download error
-		err = res.Err()
-		if err != nil {
-			d := dialog.NewError(&FatalDownloadFailure{err}, state.window)
-			d.SetOnClosed(func() {
-				state.App.Quit()
-			})
-			d.Show()
-			return
 		}
 
 		// Load install state
 		loadDatabaseResume(folderPath, true, state)
-		w.SetContent(mainLayout(state.window, state))
+		openInstallLayout(state.window, state)
 	})
 	if installName == state.Meta.Current {
 		buttonNewInstall.Disable()
@@ -385,37 +368,24 @@ func mainLayout(w fyne.Window, state *InstallerState) *fyne.Container {
 		versionHeaderLabel,
 		versionLabel)
 
-	// Create active file bars
-	fileLabel := widget.NewLabel("File: ")
-	fileLabel.TextStyle = fyne.TextStyle{Bold: true}
-	fileHeader1 := widget.NewLabelWithData(state.fileTitle1)
-	fileHeader1.Alignment = fyne.TextAlignLeading
-	fileHeader1.Wrapping = fyne.TextTruncate
-	fileContainer1 := container.NewBorder(nil, nil, fileLabel, nil, fileHeader1)
-	fileProgressBar1 := widget.NewProgressBarWithData(state.fileProgress1)
-
-	fileHeader2 := widget.NewLabelWithData(state.fileTitle2)
-	fileHeader2.Alignment = fyne.TextAlignLeading
-	fileHeader2.Wrapping = fyne.TextTruncate
-	fileContainer2 := container.NewBorder(nil, nil, fileLabel, nil, fileHeader2)
-	fileProgressBar2 := widget.NewProgressBarWithData(state.fileProgress2)
-
-	fileHeader3 := widget.NewLabelWithData(state.fileTitle3)
-	fileHeader3.Alignment = fyne.TextAlignLeading
-	fileHeader3.Wrapping = fyne.TextTruncate
-	fileContainer3 := container.NewBorder(nil, nil, fileLabel, nil, fileHeader3)
-	fileProgressBar3 := widget.NewProgressBarWithData(state.fileProgress3)
-
-	fileHeader4 := widget.NewLabelWithData(state.fileTitle4)
-	fileHeader4.Alignment = fyne.TextAlignLeading
-	fileHeader4.Wrapping = fyne.TextTruncate
-	fileContainer4 := container.NewBorder(nil, nil, fileLabel, nil, fileHeader4)
-	fileProgressBar4 := widget.NewProgressBarWithData(state.fileProgress4)
+	// Create active file bars, one for each worker
+	fileList := container.New(layout.NewVBoxLayout())
+	for i := range state.fileTitles {
+		fileLabel := widget.NewLabel("File: ")
+		fileLabel.TextStyle = fyne.TextStyle{Bold: true}
+		fileHeader := widget.NewLabelWithData(state.fileTitles[i])
+		fileHeader.Alignment = fyne.TextAlignLeading
+		fileHeader.Wrapping = fyne.TextTruncate
+		fileList.Add(container.NewBorder(nil, nil, fileLabel, nil, fileHeader))
+		fileList.Add(widget.NewProgressBarWithData(state.fileProgresses[i]))
+	}
 
 	progressBarTotal := widget.NewProgressBarWithData(state.progressBarTotal)
 	totalLabel := canvas.NewText("Total Progress...", color.White)
 
 	rateLimitCurrentLabel := widget.NewLabelWithData(state.formatRateLimit)
+	scheduleLabel := widget.NewLabelWithData(state.formatSchedule)
+	scheduleLabel.TextStyle = fyne.TextStyle{Italic: true}
 	rateLimitEntry := widget.NewEntryWithData(state.rateLimitEntry)
 	rateLimitSet := widget.NewButton("Set (KB/s)", func() {
 		// Turn entry into number
@@ -449,11 +419,109 @@ func mainLayout(w fyne.Window, state *InstallerState) *fyne.Container {
 			}
 		}
 
-		state.Grabber.RateLimit = rateLimit * 1024
+		// Applies to running downloads straight away
+		state.Grabber.SetRateLimit(rateLimit * 1024)
+	})
+
+	scheduleSet := widget.NewButton("Schedule", func() {
+		scheduleEntry := widget.NewMultiLineEntry()
+		scheduleEntry.SetText(formatSchedule(state.schedule))
+		scheduleEntry.SetPlaceHolder("09:00-18:00 2048\n01:00-05:00 pause")
+		content := container.NewBorder(
+			widget.NewLabel("One time of day per line, followed by a speed limit in KB/s (0 for unlimited) or pause.\nThe speed limit set above applies outside these times."),
+			nil, nil, nil,
+			container.NewGridWrap(fyne.Size{Width: 500, Height: 150}, scheduleEntry))
+		dialog.NewCustomConfirm("Download Schedule", "Save", "Cancel", content, func(confirmed bool) {
+			if !confirmed {
+				return
+			}
+			schedule, err := parseSchedule(scheduleEntry.Text)
+			if err != nil {
+				dialog.NewError(err, w).Show()
+				return
+			}
+			state.schedule = schedule
+			state.App.Preferences().SetString("schedule", formatSchedule(schedule))
+			// Applies to running downloads straight away
+			state.Grabber.SetSchedule(schedule)
+		}, w).Show()
+	})
+
+	quotaSet := widget.NewButton("Quota", func() {
+		formatGB := func(gb float64) string {
+			if gb == 0 {
+				return ""
+			}
+			return strconv.FormatFloat(gb, 'f', -1, 64)
+		}
+		sessionEntry := widget.NewEntry()
+		sessionEntry.SetText(formatGB(state.sessionQuotaGB))
+		sessionEntry.SetPlaceHolder("No limit")
+		monthlyEntry := widget.NewEntry()
+		monthlyEntry.SetText(formatGB(state.monthlyQuotaGB))
+		monthlyEntry.SetPlaceHolder("No limit")
+		sessionUsed, monthUsed := state.Grabber.DataUsage()
+		items := []*widget.FormItem{
+			{Text: "This session (GB):", Widget: sessionEntry, HintText: FormatBytes(sessionUsed) + " used"},
+			{Text: "This month (GB):", Widget: monthlyEntry, HintText: FormatBytes(monthUsed) + " used"},
+		}
+		dialog.NewForm("Data Quota", "Save", "Cancel", items, func(confirmed bool) {
+			if !confirmed {
+				return
+			}
+			parseGB := func(text string) (float64, error) {
+				if strings.TrimSpace(text) == "" {
+					return 0, nil
+				}
+				gb, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+				if err != nil || gb < 0 {
+					return 0, &BadQuota{}
+				}
+				return gb, nil
+			}
+			sessionGB, err := parseGB(sessionEntry.Text)
+			if err != nil {
+				dialog.NewError(err, w).Show()
+				return
+			}
+			monthlyGB, err := parseGB(monthlyEntry.Text)
+			if err != nil {
+				dialog.NewError(err, w).Show()
+				return
+			}
+			state.sessionQuotaGB = sessionGB
+			state.monthlyQuotaGB = monthlyGB
+			state.App.Preferences().SetFloat("session-quota-gb", sessionGB)
+			state.App.Preferences().SetFloat("monthly-quota-gb", monthlyGB)
+			state.Grabber.SetQuota(quotaFromGB(sessionGB, monthlyGB))
+		}, w).Show()
+	})
+
+	rateLimContainer := container.NewBorder(nil, nil, nil, container.NewHBox(rateLimitSet, scheduleSet, quotaSet), rateLimitEntry)
 
-		// Restart downloader
-		if state.Grabber.running {
+	workersEntry := widget.NewEntryWithData(state.workersEntry)
+	workersSet := widget.NewButton("Set (Downloads)", func() {
+		entryWorkers, err := state.workersEntry.Get()
+		if err != nil {
+			dialog.NewError(err, w).Show()
+			return
+		}
+		workers, err := strconv.Atoi(entryWorkers)
+		if err != nil || workers < 1 || workers > maxWorkers {
+			dialog.NewError(&BadWorkerCount{}, w).Show()
+			return
+		}
+		state.App.Preferences().SetInt("workers", workers)
+
+		// Restart downloader with the new number of active files
+		running := state.Grabber.Running()
+		if running {
 			state.Grabber.Stop(false)
+		}
+		setFileSlots(state, workers)
+		state.Grabber.Workers = workers
+		w.SetContent(mainLayout(w, state))
+		if running {
 			err = state.Grabber.Resume()
 			if err != nil {
 				dialog.NewError(&FatalDownloadFailure{err}, w).Show()
@@ -462,12 +530,17 @@ func mainLayout(w fyne.Window, state *InstallerState) *fyne.Container {
 		}
 	})
 
-	rateLimContainer := container.NewBorder(nil, nil, nil, rateLimitSet, rateLimitEntry)
+	workersContainer := container.NewBorder(nil, nil, nil, workersSet, workersEntry)
 
 	// Create buttons
 	button1 := widget.NewButton("Start", func() {
 		err := state.Grabber.Resume()
 		if err != nil {
+			var reached *QuotaReached
+			if errors.As(err, &reached) {
+				promptContinuePastQuota(state, reached)
+				return
+			}
 			dialog.NewError(&FatalDownloadFailure{err}, w).Show()
 			return
 		}
@@ -492,18 +565,14 @@ func mainLayout(w fyne.Window, state *InstallerState) *fyne.Container {
 			state.Grabber.Stop(false)
 
 			// Clear Done state for all entries
-			err := state.Repo.ResetDownloadState()
+			err := state.Grabber.ResetDownloadState()
 			if err != nil {
 				dialog.NewError(&DatabaseError{err}, w).Show()
 				return
 			}
 
 			// Update progress state
-			_ = state.progressBarTotal.Set(0)
-			state.downloadedFiles = 0
-			state.downloadedSize = 0
-			_ = state.formatDownloadedFiles.Set("0")
-			_ = state.formatDownloadedSize.Set("0.0B")
+			setProgressBindings(state, state.Grabber.Progress())
 
 			// Start downloader again
 			err = state.Grabber.Resume()
@@ -514,12 +583,130 @@ func mainLayout(w fyne.Window, state *InstallerState) *fyne.Container {
 		}, w).Show()
 	})
 
+	button4 := widget.NewButton("Verify Files", func() {
+		dialog.NewConfirm("Verify Files?", "Every downloaded file will be checked on disk, this may take a while.\nOnly missing or damaged files will be downloaded again.", func(success bool) {
+			if !success {
+				return
+			}
+
+			// Stop downloader
+			state.Grabber.Stop(false)
+
+			installPath, err := state.folderPath.Get()
+			if err != nil {
+				dialog.NewError(err, w).Show()
+				return
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			progressData := binding.NewFloat()
+			statusData := binding.NewString()
+			showCancellableProgressScreen("Verifying Files...", w, progressData, statusData, cancel)
+			go func() {
+				defer cancel()
+				result, err := verifyFiles(ctx, state.Repo, installPath, state.workers, func(p VerifyProgress) {
+					_ = progressData.Set(p.Fraction())
+					_ = statusData.Set(p.String())
+				})
+				w.SetContent(mainLayout(w, state))
+				if err != nil {
+					dialog.NewError(&DatabaseError{err}, w).Show()
+					return
+				}
+
+				// Update progress state
+				err = state.Grabber.ReloadProgress()
+				if err != nil {
+					dialog.NewError(&DatabaseError{err}, w).Show()
+					return
+				}
+				setProgressBindings(state, state.Grabber.Progress())
+
+				if result.Missing+result.Corrupt == 0 {
+					dialog.NewInformation("Verify Finished", result.String(), w).Show()
+					return
+				}
+				dialog.NewInformation("Verify Finished", result.String()+"\nDamaged files will now be downloaded again.", w).Show()
+
+				// Start downloader again to replace damaged files
+				err = state.Grabber.Resume()
+				if err != nil {
+					dialog.NewError(&FatalDownloadFailure{err}, w).Show()
+				}
+			}()
+		}, w).Show()
+	})
+
+	button5 := widget.NewButton("Seed From Folder", func() {
+		dialog.ShowFolderOpen(func(f fyne.ListableURI, err error) {
+			if err != nil {
+				dialog.NewError(err, w).Show()
+				return
+			}
+			if f == nil {
+				return
+			}
+			seedPath := f.Path()
+
+			hardlinkCheck := widget.NewCheck("Hardlink instead of copying (same drive only)", nil)
+			content := container.NewVBox(
+				widget.NewLabel("Files still to be downloaded will be copied from:\n"+seedPath+"\nOnly files matching this version are used."),
+				hardlinkCheck)
+			dialog.NewCustomConfirm("Seed From Folder?", "Seed", "Cancel", content, func(success bool) {
+				if !success {
+					return
+				}
+
+				// Stop downloader
+				state.Grabber.Stop(false)
+
+				installPath, err := state.folderPath.Get()
+				if err != nil {
+					dialog.NewError(err, w).Show()
+					return
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				progressData := binding.NewFloat()
+				statusData := binding.NewString()
+				showCancellableProgressScreen("Seeding Files...", w, progressData, statusData, cancel)
+				go func() {
+					defer cancel()
+					result, err := seedFiles(ctx, state.Repo, installPath, seedPath, hardlinkCheck.Checked, state.workers, func(p SeedProgress) {
+						_ = progressData.Set(p.Fraction())
+						_ = statusData.Set(p.String())
+					})
+					w.SetContent(mainLayout(w, state))
+					if err != nil {
+						dialog.NewError(err, w).Show()
+						return
+					}
+
+					// Update progress state
+					err = state.Grabber.ReloadProgress()
+					if err != nil {
+						dialog.NewError(&DatabaseError{err}, w).Show()
+						return
+					}
+					progress := state.Grabber.Progress()
+					setProgressBindings(state, progress)
+
+					message := result.String()
+					if remaining := progress.TotalFiles - progress.DownloadedFiles; remaining > 0 {
+						message += fmt.Sprintf("\n%s files are left to download, press Start to fetch them.", humanize.Comma(remaining))
+					}
+					dialog.NewInformation("Seed Finished", message, w).Show()
+				}()
+			}, w).Show()
+		}, w)
+	})
+
 	runningLabel := widget.NewLabelWithData(state.runningLabel)
 	runningLabel.Alignment = fyne.TextAlignCenter
 	runningLabel.TextStyle = fyne.TextStyle{Bold: true}
 
 	// Create a row with buttons
-	buttonsRow := container.NewBorder(nil, nil, container.NewHBox(button1, button2, button3), nil, runningLabel)
+	buttonsRow := container.NewBorder(nil, nil, container.NewHBox(button1, button2, button3, button4, button5), nil, runningLabel)
 
 	// Create stats labels
 	downloadedLabel := widget.NewLabelWithData(state.formatDownloadedSize)
@@ -548,17 +735,37 @@ func mainLayout(w fyne.Window, state *InstallerState) *fyne.Container {
 	speedLabel.Alignment = fyne.TextAlignLeading
 	speedLabel.TextStyle = fyne.TextStyle{Monospace: true}
 
+	workersLabel := widget.NewLabelWithData(state.formatWorkers)
+	workersLabel.Alignment = fyne.TextAlignLeading
+	workersLabel.TextStyle = fyne.TextStyle{Monospace: true}
+
 	failureLabel := widget.NewLabelWithData(state.formatDownloadFailures)
 	failureLabel.Alignment = fyne.TextAlignLeading
 	failureLabel.TextStyle = fyne.TextStyle{Monospace: true}
 
+	failuresButton := widget.NewButton("Details", func() {
+		showFailures(state)
+	})
+	failuresContainer := container.NewHBox(failureLabel, failuresButton)
+
+	mirrorsButton := widget.NewButton("Details", func() {
+		showMirrorStats(state)
+	})
+	mirrorCount := 0
+	if state.Grabber != nil {
+		mirrorCount = len(state.Grabber.MirrorStats())
+	}
+	mirrorsContainer := container.NewHBox(widget.NewLabel(strconv.Itoa(mirrorCount)), mirrorsButton)
+
 	statsForm := &widget.Form{
 		Items: []*widget.FormItem{
 			{Text: "Downloaded:", Widget: downloadedContainer},
 			{Text: "Files:", Widget: filesContainer},
-			{Text: "Failures:", Widget: failureLabel},
+			{Text: "Failures:", Widget: failuresContainer},
 			{Text: "Average Speed:", Widget: speedLabel},
-			{Text: "Download Speed Limit:", Widget: rateLimitCurrentLabel},
+			{Text: "Downloads:", Widget: workersLabel},
+			{Text: "Mirrors:", Widget: mirrorsContainer},
+			{Text: "Download Speed Limit:", Widget: container.NewHBox(rateLimitCurrentLabel, scheduleLabel)},
 		},
 	}
 
@@ -569,19 +776,11 @@ func mainLayout(w fyne.Window, state *InstallerState) *fyne.Container {
 		statsForm,
 		layout.NewSpacer(),
 		rateLimContainer,
+		workersContainer,
 		buttonsRow,
 	)
 
-	rightMainContent := container.New(layout.NewVBoxLayout(),
-		versionContainer,
-		fileContainer1,
-		fileProgressBar1,
-		fileContainer2,
-		fileProgressBar2,
-		fileContainer3,
-		fileProgressBar3,
-		fileContainer4,
-		fileProgressBar4)
+	rightMainContent := container.NewBorder(versionContainer, nil, nil, nil, container.NewVScroll(fileList))
 
 	mainContent := container.NewBorder(nil, nil, leftMainContent, nil, rightMainContent)
 
@@ -591,6 +790,60 @@ func mainLayout(w fyne.Window, state *InstallerState) *fyne.Container {
 	return mainLayout
 }
 
+// openInstallLayout shows the install screen, first finishing any scan for files already in the install folder.
+// Cancelling the scan returns to the setup screen, and it continues from where it stopped next time.
+func openInstallLayout(w fyne.Window, state *InstallerState) {
+	if state.Repo == nil {
+		return
+	}
+	pending, err := adoptScanPending(state.Repo)
+	if err != nil {
+		dialog.NewError(&DatabaseError{err}, w).Show()
+		return
+	}
+	if !pending {
+		w.SetContent(mainLayout(w, state))
+		return
+	}
+
+	installPath, err := state.folderPath.Get()
+	if err != nil {
+		dialog.NewError(err, w).Show()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	progressData := binding.NewFloat()
+	statusData := binding.NewString()
+	showCancellableProgressScreen("Checking Existing Files...", w, progressData, statusData, cancel)
+	go func() {
+		defer cancel()
+		result, err := adoptFiles(ctx, state.Repo, installPath, state.workers, func(p AdoptProgress) {
+			_ = progressData.Set(p.Fraction())
+			_ = statusData.Set(p.String())
+		})
+		if err != nil {
+			w.SetContent(setupLayout(w, state))
+			dialog.NewError(&DatabaseError{err}, w).Show()
+			return
+		}
+
+		// Found files count towards the totals shown
+		reloadErr := state.Grabber.ReloadProgress()
+		setProgressBindings(state, state.Grabber.Progress())
+		if ctx.Err() != nil {
+			w.SetContent(setupLayout(w, state))
+			return
+		}
+		w.SetContent(mainLayout(w, state))
+		if reloadErr != nil {
+			dialog.NewError(&DatabaseError{reloadErr}, w).Show()
+			return
+		}
+		dialog.NewInformation("Existing Files Checked",
+			fmt.Sprintf("%s files were already downloaded and will be skipped", humanize.Comma(result.Found)), w).Show()
+	}()
+}
+
 func topBarLayout(activeTab string) *fyne.Container {
 	label1 := widget.NewLabelWithStyle("Setup", fyne.TextAlignCenter, fyne.TextStyle{Bold: activeTab == "setup"})
 	label2 := widget.NewLabel(">")
@@ -611,6 +864,43 @@ func topBarLayout(activeTab string) *fyne.Container {
 		line)
 }
 
+// downloadIndex fetches the index database, reporting progress as a fraction until finished.
+// The index is only moved into place once fully downloaded.
+func downloadIndex(dbPath string, indexUrl string, onProgress func(float64)) error {
+	tmpPath := dbPath + ".download"
+	err := os.Remove(tmpPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	req, err := grab.NewRequest(tmpPath, indexUrl)
+	if err != nil {
+		return err
+	}
+
+	// Download file
+	client := grab.NewClient()
+	res := client.Do(req)
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			onProgress(res.Progress())
+		case <-res.Done:
+			onProgress(res.Progress())
+			if res.Err() != nil {
+				return res.Err()
+			}
+			// A log left behind by an older index would be replayed into the new one
+			err = removeDatabase(dbPath)
+			if err != nil {
+				return err
+			}
+			return os.Rename(tmpPath, dbPath)
+		}
+	}
+}
+
 func validatePath(p string) (string, bool, error) {
 	/** Check order of:
 	* Root folder (is it empty, or an FP folder)
@@ -710,47 +1000,10 @@ func loadDatabaseResume(p string, resumable bool, state *InstallerState) {
 		defer func() {
 			state.window.SetContent(setupLayout(state.window, state))
 		}()
-		repo, err := OpenDatabase(filepath.Join(p, "ultimate.sqlite"))
-		if err != nil {
-			dialog.NewError(&BrokenResumableState{err}, state.window).Show()
-			return
-		}
-		overview, err := repo.GetOverview()
-		if err != nil {
-			dialog.NewError(&BrokenResumableState{err}, state.window).Show()
-			return
-		}
-		totalDownloadedSize, err := repo.GetTotalDownloadedSize()
-		if err != nil {
-			dialog.NewError(&BrokenResumableState{err}, state.window).Show()
-			return
-		}
-		totalDownloadedFiles, err := repo.GetTotalDownladedFiles()
-		if err != nil {
-			dialog.NewError(&BrokenResumableState{err}, state.window).Show()
-			return
-		}
-		_ = state.installName.Set(overview.Name)
-		state.totalFiles = overview.TotalFiles
-		state.totalSize = overview.TotalSize
-		state.downloadedFiles = totalDownloadedFiles
-		state.downloadedSize = totalDownloadedSize
-		state.baseUrl = overview.BaseUrl
-		_ = state.formatDownloadedFiles.Set(humanize.Comma(state.downloadedFiles))
-		_ = state.formatDownloadedSize.Set(FormatBytes(state.downloadedSize))
-		_ = state.formatTotalFiles.Set(humanize.Comma(state.totalFiles))
-		_ = state.formatTotalSize.Set(FormatBytes(state.totalSize))
-		progress := float64(state.downloadedSize) / float64(state.totalSize) * 100
-		err = state.progressBarTotal.Set(progress)
+		err = loadInstallState(p, state)
 		if err != nil {
 			dialog.NewError(err, state.window).Show()
-		}
-		state.Repo = repo
-		state.resumable = false
-		for _, v := range state.Meta.Available {
-			if v == overview.Name {
-				state.resumable = true
-			}
+			return
 		}
 		if !state.resumable {
 			dialog.NewError(&VersionTooOld{}, state.window).Show()
@@ -771,6 +1024,41 @@ func loadDatabaseResume(p string, resumable bool, state *InstallerState) {
 	}
 }
 
+// loadInstallState opens the install database at the given path and sets up a downloader for it
+func loadInstallState(p string, state *InstallerState) error {
+	repo, err := OpenDatabase(filepath.Join(p, "ultimate.sqlite"))
+	if err != nil {
+		return brokenState(err)
+	}
+	grabber, err := NewDownloader(repo, p)
+	if err != nil {
+		_ = repo.Close()
+		return &BrokenResumableState{err}
+	}
+	grabber.Workers = state.workers
+	grabber.Adaptive = state.adaptive
+	grabber.SegmentThreshold = segmentThreshold(state.Config.SegmentThresholdMB)
+	grabber.Retry = retryPolicy(state.Config.MaxRetries, state.Config.MaxRetryDelaySeconds)
+	grabber.Timeouts = timeoutsFromConfig(state.Config.ConnectTimeoutSeconds, state.Config.TLSTimeoutSeconds, state.Config.IdleTimeoutSeconds)
+	grabber.AddMirrors(state.Meta.Mirrors)
+	grabber.AddListener(newUiListener(state))
+	_ = state.formatSchedule.Set("")
+	grabber.SetSchedule(state.schedule)
+	grabber.SetQuota(quotaFromGB(state.sessionQuotaGB, state.monthlyQuotaGB))
+	overview := grabber.Overview()
+	_ = state.installName.Set(overview.Name)
+	setProgressBindings(state, grabber.Progress())
+	state.Repo = repo
+	state.Grabber = grabber
+	state.resumable = false
+	for _, v := range state.Meta.Available {
+		if v == overview.Name {
+			state.resumable = true
+		}
+	}
+	return nil
+}
+
 func openWaitScreen(message string, w fyne.Window) {
 	// Create a dialog to show the operation status
 	progressBar := widget.NewProgressBarInfinite()
@@ -794,3 +1082,20 @@ func showProgressScreen(message string, w fyne.Window, progressData binding.Floa
 
 	w.SetContent(dialogContent)
 }
+
+func showCancellableProgressScreen(message string, w fyne.Window, progressData binding.Float, statusData binding.String, onCancel func()) {
+	// Create a dialog to show the operation status, with a way to stop it early
+	progressBar := widget.NewProgressBarWithData(progressData)
+	cancelButton := widget.NewButton("Cancel", func() {
+		onCancel()
+	})
+	dialogContent := container.NewCenter(
+		container.NewVBox(
+			widget.NewLabel(message),
+			progressBar,
+			widget.NewLabelWithData(statusData),
+			cancelButton),
+	)
+
+	w.SetContent(dialogContent)
+}
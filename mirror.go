@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// mirrorFailureLimit is how many failures in a row disable a mirror
+	mirrorFailureLimit = 3
+	// mirrorDisableTime is how long a disabled mirror is skipped before being tried again
+	mirrorDisableTime = 2 * time.Minute
+	// mirrorProbeInterval is how often mirrors are probed again while downloading
+	mirrorProbeInterval = 5 * time.Minute
+	// mirrorProbeSize is how many bytes are requested from each mirror when probing
+	mirrorProbeSize = 64 * 1024
+	// mirrorMinSample is the smallest transfer counted towards a mirror's throughput, smaller ones are mostly latency
+	mirrorMinSample = 32 * 1024
+)
+
+// Mirror is a server hosting the same files as the index base url. Mirrors with a lower priority are tried first.
+type Mirror struct {
+	BaseUrl  string `json:"base_url"`
+	Priority int    `json:"priority"`
+}
+
+type mirrorState struct {
+	Mirror
+	failures      int
+	disabledUntil time.Time
+	latency       time.Duration // From the last probe
+	probeSpeed    float64       // Bytes per second from the last probe
+	speed         float64       // Moving average bytes per second of completed transfers
+	files         int64
+	bytes         int64
+	totalFailures int64
+}
+
+// estimate returns the expected throughput of the mirror, or 0 if nothing is known yet
+func (s *mirrorState) estimate() float64 {
+	if s.speed > 0 {
+		return s.speed
+	}
+	return s.probeSpeed
+}
+
+// MirrorStats is a snapshot of how a mirror has been performing
+type MirrorStats struct {
+	BaseUrl       string
+	Priority      int
+	Latency       time.Duration
+	Throughput    float64 // Bytes per second, 0 if unknown
+	Files         int64
+	Bytes         int64
+	Failures      int64
+	DisabledUntil time.Time
+}
+
+// Disabled reports whether the mirror is being skipped after failing repeatedly
+func (s MirrorStats) Disabled() bool {
+	return time.Now().Before(s.DisabledUntil)
+}
+
+func (s MirrorStats) String() string {
+	status := "ok"
+	if s.Disabled() {
+		status = "disabled until " + s.DisabledUntil.Format("15:04:05")
+	}
+	latency := "-"
+	if s.Latency > 0 {
+		latency = s.Latency.Round(time.Millisecond).String()
+	}
+	speed := "-"
+	if s.Throughput > 0 {
+		speed = FormatBytes(int64(s.Throughput)) + "/s"
+	}
+	return fmt.Sprintf("%s | %s | %s | latency %s | %d files (%s) | %d failures",
+		s.BaseUrl, status, speed, latency, s.Files, FormatBytes(s.Bytes), s.Failures)
+}
+
+// MirrorSet chooses which mirror each request uses, skipping mirrors which keep failing for a while
+type MirrorSet struct {
+	mirrors []*mirrorState
+	mu      sync.Mutex
+}
+
+// NewMirrorSet creates a set from the given mirrors, ignoring repeated base urls
+func NewMirrorSet(mirrors []Mirror) *MirrorSet {
+	m := &MirrorSet{}
+	m.Add(mirrors)
+	return m
+}
+
+// Add includes more mirrors, ignoring any base url already in the set
+func (m *MirrorSet) Add(mirrors []Mirror) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, mirror := range mirrors {
+		mirror.BaseUrl = strings.TrimRight(mirror.BaseUrl, "/")
+		if mirror.BaseUrl == "" || m.find(mirror.BaseUrl) != nil {
+			continue
+		}
+		m.mirrors = append(m.mirrors, &mirrorState{Mirror: mirror})
+	}
+	sort.SliceStable(m.mirrors, func(i, j int) bool {
+		return m.mirrors[i].Priority < m.mirrors[j].Priority
+	})
+}
+
+func (m *MirrorSet) find(baseUrl string) *mirrorState {
+	for _, s := range m.mirrors {
+		if s.BaseUrl == baseUrl {
+			return s
+		}
+	}
+	return nil
+}
+
+// Len returns how many mirrors are in the set
+func (m *MirrorSet) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.mirrors)
+}
+
+// Pick returns the base url of a mirror not already tried, preferring enabled mirrors.
+// Once throughput is known, enabled mirrors are chosen at random weighted towards the fastest, otherwise the
+// lowest priority is used. Falls back to the first mirror if every mirror has been tried.
+func (m *MirrorSet) Pick(tried []string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var fallback *mirrorState
+	candidates := make([]*mirrorState, 0, len(m.mirrors))
+	for _, s := range m.mirrors {
+		if containsString(tried, s.BaseUrl) {
+			continue
+		}
+		if now.After(s.disabledUntil) {
+			candidates = append(candidates, s)
+			continue
+		}
+		if fallback == nil || s.disabledUntil.Before(fallback.disabledUntil) {
+			fallback = s
+		}
+	}
+	if len(candidates) > 0 {
+		return pickWeighted(candidates).BaseUrl
+	}
+	if fallback != nil {
+		return fallback.BaseUrl
+	}
+	if len(m.mirrors) == 0 {
+		return ""
+	}
+	return m.mirrors[0].BaseUrl
+}
+
+// pickWeighted chooses between mirrors in proportion to their expected throughput.
+// Mirrors without any measurements yet are treated as average so they still get tried.
+func pickWeighted(candidates []*mirrorState) *mirrorState {
+	known := 0
+	sum := float64(0)
+	for _, s := range candidates {
+		if s.estimate() > 0 {
+			known += 1
+			sum += s.estimate()
+		}
+	}
+	if known == 0 {
+		return candidates[0]
+	}
+	average := sum / float64(known)
+
+	weights := make([]float64, len(candidates))
+	total := float64(0)
+	for i, s := range candidates {
+		weights[i] = s.estimate()
+		if weights[i] == 0 {
+			weights[i] = average
+		}
+		total += weights[i]
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		r -= w
+		if r < 0 {
+			return candidates[i]
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// CanFailover reports whether an enabled mirror remains which hasn't been tried yet
+func (m *MirrorSet) CanFailover(tried []string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for _, s := range m.mirrors {
+		if !containsString(tried, s.BaseUrl) && now.After(s.disabledUntil) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReportSuccess marks a mirror as healthy again, counting the bytes transferred towards its throughput.
+// Pass 0 bytes for transfers which shouldn't be measured, such as resumed ones.
+func (m *MirrorSet) ReportSuccess(baseUrl string, bytes int64, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.find(baseUrl)
+	if s == nil {
+		return
+	}
+	s.failures = 0
+	s.files += 1
+	s.bytes += bytes
+	if bytes >= mirrorMinSample && duration > 0 {
+		speed := float64(bytes) / duration.Seconds()
+		if s.speed == 0 {
+			s.speed = speed
+		} else {
+			s.speed = s.speed*0.8 + speed*0.2
+		}
+	}
+}
+
+// ReportProbe records the result of a successful probe
+func (m *MirrorSet) ReportProbe(baseUrl string, latency time.Duration, speed float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.find(baseUrl)
+	if s != nil {
+		s.latency = latency
+		s.probeSpeed = speed
+	}
+}
+
+// BaseUrls returns every mirror in priority order
+func (m *MirrorSet) BaseUrls() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	urls := make([]string, len(m.mirrors))
+	for i, s := range m.mirrors {
+		urls[i] = s.BaseUrl
+	}
+	return urls
+}
+
+// Stats returns a snapshot of every mirror in priority order
+func (m *MirrorSet) Stats() []MirrorStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make([]MirrorStats, len(m.mirrors))
+	for i, s := range m.mirrors {
+		stats[i] = MirrorStats{
+			BaseUrl:       s.BaseUrl,
+			Priority:      s.Priority,
+			Latency:       s.latency,
+			Throughput:    s.estimate(),
+			Files:         s.files,
+			Bytes:         s.bytes,
+			Failures:      s.totalFailures,
+			DisabledUntil: s.disabledUntil,
+		}
+	}
+	return stats
+}
+
+// ReportFailure counts a failed request against a mirror, returning true if it has now been disabled
+func (m *MirrorSet) ReportFailure(baseUrl string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.find(baseUrl)
+	if s == nil {
+		return false
+	}
+	s.failures += 1
+	s.totalFailures += 1
+	// Only disable if there's somewhere else to go
+	if s.failures >= mirrorFailureLimit && len(m.mirrors) > 1 && time.Now().After(s.disabledUntil) {
+		s.failures = 0
+		s.disabledUntil = time.Now().Add(mirrorDisableTime)
+		return true
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// probeClient is used for probing so a stalled mirror can't hold up the others
+var probeClient = &http.Client{Timeout: 15 * time.Second}
+
+// probeMirror requests the start of a file from a mirror, measuring the time until it responds and the throughput
+func probeMirror(ctx context.Context, baseUrl string, path string) (time.Duration, float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/%s", baseUrl, path), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", mirrorProbeSize-1))
+	start := time.Now()
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	latency := time.Since(start)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, mirrorProbeSize))
+	if err != nil {
+		return 0, 0, err
+	}
+	elapsed := time.Since(start)
+	return latency, float64(n) / elapsed.Seconds(), nil
+}
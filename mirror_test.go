@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMirrorSetPick(t *testing.T) {
+	m := NewMirrorSet([]Mirror{
+		{BaseUrl: "http://c/", Priority: 2},
+		{BaseUrl: "http://a", Priority: 0},
+		{BaseUrl: "http://b", Priority: 1},
+		{BaseUrl: "http://a/", Priority: 5},
+	})
+	if got := m.Len(); got != 3 {
+		t.Fatalf("Len = %d, want repeated base urls ignored", got)
+	}
+
+	tests := []struct {
+		name  string
+		tried []string
+		want  string
+	}{
+		{"lowest priority first", nil, "http://a"},
+		{"skip tried", []string{"http://a"}, "http://b"},
+		{"skip all but one", []string{"http://a", "http://b"}, "http://c"},
+		{"everything tried", []string{"http://a", "http://b", "http://c"}, "http://a"},
+	}
+	for _, test := range tests {
+		if got := m.Pick(test.tried); got != test.want {
+			t.Errorf("%s: Pick(%v) = %s, want %s", test.name, test.tried, got, test.want)
+		}
+	}
+}
+
+func TestMirrorSetDisables(t *testing.T) {
+	m := NewMirrorSet([]Mirror{{BaseUrl: "http://a", Priority: 0}, {BaseUrl: "http://b", Priority: 1}})
+	for i := 1; i < mirrorFailureLimit; i++ {
+		if m.ReportFailure("http://a") {
+			t.Fatalf("disabled after %d failures", i)
+		}
+	}
+	if !m.ReportFailure("http://a") {
+		t.Fatalf("not disabled after %d failures", mirrorFailureLimit)
+	}
+	if got := m.Pick(nil); got != "http://b" {
+		t.Errorf("Pick = %s, want the enabled mirror", got)
+	}
+	if m.CanFailover([]string{"http://b"}) {
+		t.Error("CanFailover true with only a disabled mirror left")
+	}
+	// A disabled mirror is still used once nothing else is left
+	if got := m.Pick([]string{"http://b"}); got != "http://a" {
+		t.Errorf("Pick = %s, want the disabled mirror as a fallback", got)
+	}
+
+	// The only mirror is never disabled
+	single := NewMirrorSet([]Mirror{{BaseUrl: "http://a", Priority: 0}})
+	for i := 0; i < mirrorFailureLimit*2; i++ {
+		if single.ReportFailure("http://a") {
+			t.Fatal("disabled the only mirror")
+		}
+	}
+}
+
+func TestMirrorSetWeightsBySpeed(t *testing.T) {
+	m := NewMirrorSet([]Mirror{{BaseUrl: "http://slow", Priority: 0}, {BaseUrl: "http://fast", Priority: 1}})
+	m.ReportSuccess("http://slow", 1024*1024, 10*time.Second)
+	m.ReportSuccess("http://fast", 1024*1024, time.Second)
+
+	picks := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		picks[m.Pick(nil)] += 1
+	}
+	// Roughly 10 to 1, allow plenty of room for chance
+	if picks["http://fast"] < picks["http://slow"]*4 {
+		t.Errorf("picked fast %d times and slow %d times, want fast favoured", picks["http://fast"], picks["http://slow"])
+	}
+	if picks["http://slow"] == 0 {
+		t.Error("never picked the slow mirror, it should still get some requests")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+const (
+	// networkFailureLimit is how many requests in a row can fail to connect before waiting for the network
+	networkFailureLimit = 5
+	// networkProbeInterval is how often the mirrors are tried while waiting for the network
+	networkProbeInterval = 10 * time.Second
+)
+
+// networkBreaker notices when requests keep failing to reach any server, so files can wait for the network
+// to come back instead of using up their retries
+type networkBreaker struct {
+	failures int
+	waiting  bool
+	restored chan struct{} // Closed when the network comes back
+	mu       sync.Mutex
+}
+
+func newNetworkBreaker() *networkBreaker {
+	restored := make(chan struct{})
+	close(restored)
+	return &networkBreaker{restored: restored}
+}
+
+// Failure counts a request which couldn't reach its server, returning true if the network is now considered down
+func (b *networkBreaker) Failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures += 1
+	if b.waiting || b.failures < networkFailureLimit {
+		return false
+	}
+	b.waiting = true
+	b.restored = make(chan struct{})
+	return true
+}
+
+// Success resets the count of failed requests, returning true if the network was considered down until now
+func (b *networkBreaker) Success() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	if !b.waiting {
+		return false
+	}
+	b.waiting = false
+	close(b.restored)
+	return true
+}
+
+// Waiting reports whether the network is considered down
+func (b *networkBreaker) Waiting() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.waiting
+}
+
+// Restored returns a channel which is closed once the network is back, already closed if it isn't down
+func (b *networkBreaker) Restored() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.restored
+}
+
+// reportNetwork feeds the result of a request into the network breaker, starting to probe for the network
+// coming back when too many requests in a row couldn't connect
+func (d *Downloader) reportNetwork(err error) {
+	if err == nil {
+		if d.network.Success() {
+			d.emit(&NetworkEvent{Waiting: false})
+		}
+		return
+	}
+	if !classifyError(err).Network() {
+		return
+	}
+	if d.network.Failure() {
+		d.emit(&NetworkEvent{Waiting: true})
+		d.responderWg.Add(1)
+		go func(ctx context.Context) {
+			defer d.responderWg.Done()
+			d.waitForNetwork(ctx)
+		}(d.ctx)
+	}
+}
+
+// waitForNetwork probes the mirrors until one answers, then lets waiting files continue
+func (d *Downloader) waitForNetwork(ctx context.Context) {
+	t := time.NewTicker(networkProbeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.network.Restored():
+			// A request got through on its own
+			return
+		case <-t.C:
+		}
+
+		path, err := d.repo.GetProbeFile()
+		if err != nil {
+			if err != sql.ErrNoRows {
+				d.emit(&FatalErrorEvent{&DatabaseError{err}})
+			}
+			return
+		}
+		for _, baseUrl := range d.mirrors.BaseUrls() {
+			_, _, err := probeMirror(ctx, baseUrl, path)
+			if err == nil {
+				d.reportNetwork(nil)
+				return
+			}
+		}
+	}
+}
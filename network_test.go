@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+)
+
+// isClosed reports whether a Restored channel has been closed
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestNetworkBreaker(t *testing.T) {
+	b := newNetworkBreaker()
+	if b.Waiting() || !isClosed(b.Restored()) {
+		t.Fatal("new breaker waiting for the network")
+	}
+
+	// A success partway resets the count
+	for i := 0; i < networkFailureLimit-1; i++ {
+		b.Failure()
+	}
+	if b.Success() {
+		t.Error("success reported the network as restored though it wasn't down")
+	}
+	for i := 0; i < networkFailureLimit-1; i++ {
+		if b.Failure() {
+			t.Fatalf("down after %d failures, want %d", i+1, networkFailureLimit)
+		}
+	}
+	if b.Waiting() {
+		t.Fatal("waiting below the failure limit")
+	}
+
+	// Opens once at the limit, further failures while probing don't open it again
+	if !b.Failure() {
+		t.Fatal("not down at the failure limit")
+	}
+	restored := b.Restored()
+	if !b.Waiting() || isClosed(restored) {
+		t.Error("not waiting for the network once down")
+	}
+	if b.Failure() {
+		t.Error("reported down again while already waiting")
+	}
+
+	// The first success closes it and wakes everything waiting
+	if !b.Success() {
+		t.Error("success didn't report the network as restored")
+	}
+	if b.Waiting() || !isClosed(restored) {
+		t.Error("still waiting after the network came back")
+	}
+	if b.Success() {
+		t.Error("restored reported twice")
+	}
+
+	// And it can open again after coming back
+	for i := 0; i < networkFailureLimit-1; i++ {
+		b.Failure()
+	}
+	if !b.Failure() || isClosed(b.Restored()) {
+		t.Error("not down again after a second outage")
+	}
+}
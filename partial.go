@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// partialDir holds downloads under the install folder until they pass their checksum, so the launcher never
+// sees an unfinished or damaged file at the real path
+const partialDir = ".ultpart"
+
+// partialPath returns where a file is downloaded to before it's moved into place
+func partialPath(installPath string, path string) string {
+	return filepath.Join(installPath, partialDir, path)
+}
+
+// finishPartial moves a verified download into place, replacing any older version of the file.
+// It's synced to disk first, so a crash can't leave a file in place which is missing its contents.
+func finishPartial(installPath string, f *IndexedFile) error {
+	src := partialPath(installPath, f.Filepath)
+	err := syncFile(src)
+	if err != nil {
+		return err
+	}
+	return placePartial(installPath, f)
+}
+
+// placePartial moves a staged file into place without syncing it first, for files already on disk such as hardlinks
+func placePartial(installPath string, f *IndexedFile) error {
+	dest := filepath.Join(installPath, f.Filepath)
+	err := os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return os.Rename(partialPath(installPath, f.Filepath), dest)
+}
+
+// cleanPartials removes unfinished downloads for files which are no longer queued, such as ones dropped by an
+// upgrade or already downloaded another way. The rest are kept to be resumed.
+func cleanPartials(repo *SqliteRepo, installPath string) error {
+	root := filepath.Join(installPath, partialDir)
+	dirs := make([]string, 0)
+	err := filepath.WalkDir(root, func(p string, e fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if e.IsDir() {
+			dirs = append(dirs, p)
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		path := filepath.ToSlash(rel)
+		queued, err := repo.GetQueuedFile(path)
+		if err != nil {
+			return err
+		}
+		if queued != nil {
+			return nil
+		}
+		err = os.Remove(p)
+		if err != nil {
+			return err
+		}
+		return repo.ClearSegments(path)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Deepest first, anything still holding a partial download stays, and the staging folder goes once it's empty
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		_ = os.Remove(dir)
+	}
+	return nil
+}
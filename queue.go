@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+)
+
+const (
+	// queuePageSize is how many pending files are read from the index at once
+	queuePageSize = 1000
+	// queuePrefetch is how few files can be left before the next page is read in the background
+	queuePrefetch = queuePageSize / 4
+)
+
+// fileQueue hands out pending files in index order, reading them from the repo a page at a time before they're
+// needed. Each page is marked taken in one go, and everything is given back at once when the downloader stops.
+type fileQueue struct {
+	repo       *SqliteRepo
+	failedOnly bool
+	files      []*IndexedFile
+	lastRowid  int64
+	exhausted  bool
+	fetching   chan struct{} // Closed once the page being read in the background is ready, nil if not reading
+	err        error
+	mu         sync.Mutex
+}
+
+func newFileQueue(repo *SqliteRepo, failedOnly bool) *fileQueue {
+	return &fileQueue{
+		repo:       repo,
+		failedOnly: failedOnly,
+		files:      make([]*IndexedFile, 0),
+	}
+}
+
+// Next returns the next file to download, or nil once every pending file has been handed out
+func (q *fileQueue) Next() (*IndexedFile, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.files) == 0 {
+		if q.err != nil {
+			return nil, q.err
+		}
+		if q.exhausted {
+			return nil, nil
+		}
+		q.prefetch()
+		fetching := q.fetching
+		q.mu.Unlock()
+		<-fetching
+		q.mu.Lock()
+	}
+
+	f := q.files[0]
+	q.files = q.files[1:]
+	if len(q.files) <= queuePrefetch {
+		q.prefetch()
+	}
+	return f, nil
+}
+
+// prefetch starts reading the next page in the background if it isn't already, must be called with the lock held
+func (q *fileQueue) prefetch() {
+	if q.fetching != nil || q.exhausted || q.err != nil {
+		return
+	}
+	fetching := make(chan struct{})
+	q.fetching = fetching
+	afterRowid := q.lastRowid
+	go func() {
+		defer close(fetching)
+		files, err := q.repo.TakeQueuedFiles(afterRowid, queuePageSize, q.failedOnly)
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.fetching = nil
+		if err != nil {
+			q.err = err
+			return
+		}
+		if len(files) < queuePageSize {
+			q.exhausted = true
+		}
+		if len(files) > 0 {
+			q.lastRowid = files[len(files)-1].rowid
+		}
+		q.files = append(q.files, files...)
+	}()
+}
+
+// Wait waits for any page being read in the background, so nothing is marked taken after the files are given back
+func (q *fileQueue) Wait() {
+	q.mu.Lock()
+	fetching := q.fetching
+	q.mu.Unlock()
+	if fetching != nil {
+		<-fetching
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFileQueueHandsOutEachFileOnce(t *testing.T) {
+	files := numberedFiles(queuePageSize*2 + queuePageSize/2)
+	repo := openTestIndex(t, "http://localhost", files...)
+	q := newFileQueue(repo, false)
+
+	seen := make(map[string]bool)
+	for {
+		f, err := q.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f == nil {
+			break
+		}
+		if seen[f.Filepath] {
+			t.Fatalf("%s handed out twice", f.Filepath)
+		}
+		seen[f.Filepath] = true
+	}
+	q.Wait()
+	if len(seen) != len(files) {
+		t.Errorf("handed out %d files, want %d", len(seen), len(files))
+	}
+	// Stays empty once exhausted
+	f, err := q.Next()
+	if err != nil || f != nil {
+		t.Errorf("Next after exhausted = %v, %v", f, err)
+	}
+}
+
+func TestFileQueueGivesBackOnStop(t *testing.T) {
+	files := numberedFiles(queuePageSize + 10)
+	repo := openTestIndex(t, "http://localhost", files...)
+	q := newFileQueue(repo, false)
+
+	// Stop partway, like the downloader does, with some files finished
+	finished := make([]*IndexedFile, 0)
+	for i := 0; i < queuePageSize-queuePrefetch+5; i++ {
+		f, err := q.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		finished = append(finished, f)
+	}
+	q.Wait()
+	if taken := countTaken(t, repo); taken != len(files) {
+		t.Errorf("%d files taken after prefetching the next page, want %d", taken, len(files))
+	}
+	err := repo.SetFilesDone(finished, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.ClearTakenAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new run picks up everything not finished, including files prefetched but never handed out
+	q = newFileQueue(repo, false)
+	count := 0
+	for {
+		f, err := q.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f == nil {
+			break
+		}
+		count += 1
+	}
+	if want := len(files) - len(finished); count != want {
+		t.Errorf("resumed with %d files, want %d", count, want)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	quotaMonthKey      = "quota_month"
+	quotaMonthBytesKey = "quota_month_bytes"
+	// quotaSaveInterval is how often the monthly usage is written to the repo while downloading
+	quotaSaveInterval = 5 * time.Second
+)
+
+// Quota limits how much data can be downloaded, 0 for no limit
+type Quota struct {
+	SessionBytes int64
+	MonthlyBytes int64
+}
+
+// quotaFromGB converts quotas configured in GB to bytes
+func quotaFromGB(sessionGB float64, monthlyGB float64) Quota {
+	return Quota{
+		SessionBytes: int64(sessionGB * 1024 * 1024 * 1024),
+		MonthlyBytes: int64(monthlyGB * 1024 * 1024 * 1024),
+	}
+}
+
+// SetQuota sets how much data may be downloaded this session and this month before stopping
+func (d *Downloader) SetQuota(q Quota) {
+	d.quotaMu.Lock()
+	defer d.quotaMu.Unlock()
+	d.quota = q
+}
+
+// OverrideQuota lets downloading continue past a reached quota until the downloader is closed
+func (d *Downloader) OverrideQuota() {
+	d.quotaMu.Lock()
+	defer d.quotaMu.Unlock()
+	d.quotaOverride = true
+}
+
+// DataUsage returns the bytes downloaded this session and this month, including any retried
+func (d *Downloader) DataUsage() (int64, int64) {
+	d.quotaMu.Lock()
+	defer d.quotaMu.Unlock()
+	return d.sessionBytes, d.monthBytes
+}
+
+// loadDataUsage reads this month's usage from the repo, starting again from 0 in a new month
+func (d *Downloader) loadDataUsage(now time.Time) error {
+	d.quotaMu.Lock()
+	defer d.quotaMu.Unlock()
+	d.month = now.Format("2006-01")
+	d.monthBytes = 0
+	var month string
+	found, err := d.repo.GetState(quotaMonthKey, &month)
+	if err != nil {
+		return err
+	}
+	if found && month == d.month {
+		_, err = d.repo.GetState(quotaMonthBytesKey, &d.monthBytes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addDataUsage counts bytes against the quotas, saving the monthly usage every so often.
+// Returns the quota which has been reached, if any.
+func (d *Downloader) addDataUsage(bytes int64, now time.Time) (*QuotaReached, error) {
+	d.quotaMu.Lock()
+	defer d.quotaMu.Unlock()
+	month := now.Format("2006-01")
+	if month != d.month {
+		d.month = month
+		d.monthBytes = 0
+	}
+	d.sessionBytes += bytes
+	d.monthBytes += bytes
+
+	var err error
+	if now.Sub(d.lastQuotaSave) > quotaSaveInterval {
+		err = d.saveDataUsageLocked(now)
+	}
+	return d.checkQuotaLocked(), err
+}
+
+func (d *Downloader) saveDataUsage() error {
+	d.quotaMu.Lock()
+	defer d.quotaMu.Unlock()
+	return d.saveDataUsageLocked(time.Now())
+}
+
+func (d *Downloader) saveDataUsageLocked(now time.Time) error {
+	d.lastQuotaSave = now
+	err := d.repo.SetState(quotaMonthKey, d.month)
+	if err != nil {
+		return err
+	}
+	return d.repo.SetState(quotaMonthBytesKey, d.monthBytes)
+}
+
+// checkQuota returns the quota which has been reached, or nil if downloading can continue
+func (d *Downloader) checkQuota() *QuotaReached {
+	d.quotaMu.Lock()
+	defer d.quotaMu.Unlock()
+	return d.checkQuotaLocked()
+}
+
+func (d *Downloader) checkQuotaLocked() *QuotaReached {
+	if d.quotaOverride {
+		return nil
+	}
+	if d.quota.SessionBytes > 0 && d.sessionBytes >= d.quota.SessionBytes {
+		return &QuotaReached{Monthly: false, Limit: d.quota.SessionBytes}
+	}
+	if d.quota.MonthlyBytes > 0 && d.monthBytes >= d.quota.MonthlyBytes {
+		return &QuotaReached{Monthly: true, Limit: d.quota.MonthlyBytes}
+	}
+	return nil
+}
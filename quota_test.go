@@ -0,0 +1,152 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDataUsageAcrossMonths(t *testing.T) {
+	repo := openTestIndex(t, "http://localhost")
+	d, err := NewDownloader(repo, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetQuota(Quota{MonthlyBytes: 100})
+	for key, value := range map[string]any{quotaMonthKey: "2026-01", quotaMonthBytesKey: int64(90)} {
+		err = repo.SetState(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	endOfMonth := time.Date(2026, time.January, 31, 23, 59, 0, 0, time.Local)
+
+	err = d.loadDataUsage(endOfMonth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reached, err := d.addDataUsage(10, endOfMonth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reached == nil || !reached.Monthly || reached.Limit != 100 {
+		t.Errorf("reached %+v at 100 bytes this month, want the monthly quota", reached)
+	}
+
+	// A new month starts from nothing, the session keeps counting
+	reached, err = d.addDataUsage(5, endOfMonth.Add(2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reached != nil {
+		t.Errorf("reached %+v in a new month", reached)
+	}
+	if session, month := d.DataUsage(); session != 15 || month != 5 {
+		t.Errorf("usage is %d this session and %d this month, want 15 and 5", session, month)
+	}
+	err = d.saveDataUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var month string
+	var monthBytes int64
+	_, err = repo.GetState(quotaMonthKey, &month)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.GetState(quotaMonthBytesKey, &monthBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if month != "2026-02" || monthBytes != 5 {
+		t.Errorf("saved %d bytes for %s, want 5 for 2026-02", monthBytes, month)
+	}
+
+	// Usage saved in an earlier month isn't loaded
+	err = d.loadDataUsage(time.Date(2026, time.March, 1, 0, 0, 0, 0, time.Local))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, month := d.DataUsage(); month != 0 {
+		t.Errorf("loaded %d bytes from last month", month)
+	}
+}
+
+func TestSessionQuota(t *testing.T) {
+	repo := openTestIndex(t, "http://localhost")
+	d, err := NewDownloader(repo, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetQuota(Quota{SessionBytes: 10, MonthlyBytes: 1000})
+	now := time.Now()
+	err = d.loadDataUsage(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reached, err := d.addDataUsage(9, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reached != nil {
+		t.Errorf("reached %+v below the session quota", reached)
+	}
+	reached, err = d.addDataUsage(1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reached == nil || reached.Monthly || reached.Limit != 10 {
+		t.Errorf("reached %+v at 10 bytes this session, want the session quota", reached)
+	}
+
+	d.OverrideQuota()
+	reached, err = d.addDataUsage(100, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reached != nil {
+		t.Errorf("reached %+v after overriding", reached)
+	}
+}
+
+func TestDataUsageKeptOnUpgrade(t *testing.T) {
+	folderPath := t.TempDir()
+	previousPath := filepath.Join(folderPath, "ultimate-previous.sqlite")
+	files := numberedFiles(2)
+	writePreviousIndex(t, previousPath, files)
+	previous, err := OpenDatabase(previousPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for key, value := range map[string]any{quotaMonthKey: now.Format("2006-01"), quotaMonthBytesKey: int64(12345)} {
+		err = previous.SetState(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = previous.Close()
+	writeIndex(t, filepath.Join(folderPath, "ultimate.sqlite"), "http://localhost", files...)
+
+	_, err = carryOverProgress(folderPath, previousPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := OpenDatabase(filepath.Join(folderPath, "ultimate.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	d, err := NewDownloader(repo, folderPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.loadDataUsage(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, month := d.DataUsage(); month != 12345 {
+		t.Errorf("%d bytes used this month after upgrading, want 12345", month)
+	}
+}
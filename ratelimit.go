@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimiter is a token bucket shared by every transfer, so the combined speed stays at the limit no matter
+// how many downloads are active. It also counts every byte received, whether or not a limit is set.
+// The rate can be changed or paused at any time, taking effect for transfers already in progress.
+type RateLimiter struct {
+	total   int64 // Accessed atomically
+	rate    int   // Bytes per second, 0 for unlimited
+	paused  bool
+	tokens  float64
+	last    time.Time
+	changed chan struct{} // Closed when the rate changes, waking anything waiting on the old rate
+	mu      sync.Mutex
+}
+
+// NewRateLimiter creates a limiter allowing rate bytes per second in total, or unlimited if rate is 0
+func NewRateLimiter(rate int) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		last:    time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+// SetRate changes the limit to rate bytes per second, or unlimited if rate is 0
+func (l *RateLimiter) SetRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rate == l.rate {
+		return
+	}
+	l.rate = rate
+	// Forget anything owed at the old rate
+	l.tokens = 0
+	l.last = time.Now()
+	l.notify()
+}
+
+// SetPaused stops every transfer from receiving more data until unpaused
+func (l *RateLimiter) SetPaused(paused bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if paused == l.paused {
+		return
+	}
+	l.paused = paused
+	l.tokens = 0
+	l.last = time.Now()
+	l.notify()
+}
+
+// Paused reports whether transfers are held by SetPaused
+func (l *RateLimiter) Paused() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.paused
+}
+
+// notify wakes anything waiting on the old settings, must be called with the lock held
+func (l *RateLimiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Rate returns the current limit in bytes per second, or 0 if unlimited
+func (l *RateLimiter) Rate() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// WaitN takes n bytes from the bucket, waiting until the bucket has refilled enough to cover them
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	atomic.AddInt64(&l.total, int64(n))
+
+	l.mu.Lock()
+	for l.paused {
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+		l.mu.Lock()
+	}
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	l.last = now
+	// Allow at most a second of burst after being idle
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	// Take the bytes now, anything owed is paid back by waiting
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	changed := l.changed
+	l.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	case <-changed:
+		return nil
+	}
+}
+
+// Total returns how many bytes have been received through the limiter
+func (l *RateLimiter) Total() int64 {
+	return atomic.LoadInt64(&l.total)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitInBackground calls WaitN in a goroutine, sending its result once it returns
+func waitInBackground(ctx context.Context, l *RateLimiter, n int) chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- l.WaitN(ctx, n)
+	}()
+	return result
+}
+
+func expectWaiting(t *testing.T, result chan error) {
+	t.Helper()
+	select {
+	case err := <-result:
+		t.Fatalf("WaitN returned %v while it should be waiting", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func expectWoken(t *testing.T, result chan error) error {
+	t.Helper()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("WaitN still waiting")
+		return nil
+	}
+}
+
+func TestRateLimiterSetRateWakesWaiters(t *testing.T) {
+	// Owing this much at 100 bytes per second would take minutes
+	l := NewRateLimiter(100)
+	result := waitInBackground(context.Background(), l, 10000)
+	expectWaiting(t, result)
+
+	l.SetRate(0)
+	if err := expectWoken(t, result); err != nil {
+		t.Errorf("WaitN returned %v after removing the limit", err)
+	}
+	// What was owed at the old rate is forgotten, so this only takes half a second
+	l.SetRate(1000)
+	err := expectWoken(t, waitInBackground(context.Background(), l, 500))
+	if err != nil {
+		t.Errorf("WaitN returned %v within the new rate", err)
+	}
+	if l.Total() != 10500 {
+		t.Errorf("counted %d bytes, want 10500", l.Total())
+	}
+}
+
+func TestRateLimiterSetPausedHoldsWaiters(t *testing.T) {
+	l := NewRateLimiter(0)
+	l.SetPaused(true)
+	result := waitInBackground(context.Background(), l, 10)
+	expectWaiting(t, result)
+
+	l.SetPaused(false)
+	if err := expectWoken(t, result); err != nil {
+		t.Errorf("WaitN returned %v after unpausing", err)
+	}
+
+	// Cancelling gets a paused transfer out without unpausing
+	l.SetPaused(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	result = waitInBackground(ctx, l, 10)
+	expectWaiting(t, result)
+	cancel()
+	if err := expectWoken(t, result); !errors.Is(err, context.Canceled) {
+		t.Errorf("WaitN returned %v after cancelling, want context.Canceled", err)
+	}
+	if !l.Paused() {
+		t.Error("cancelling a transfer unpaused the limiter")
+	}
+}
@@ -2,23 +2,80 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	_ "github.com/mattn/go-sqlite3"
+	"os"
+	"time"
 )
 
 type SqliteRepo struct {
 	db *sql.DB
 }
 
+// schemaVersion is the newest index schema this updater understands, kept in the index as PRAGMA user_version.
+// index.py creates version 0, and the updater migrates it from there.
+const schemaVersion = 1
+
+// indexTables are the tables every index has had since the first version of index.py
+var indexTables = []string{"overview", "files", "empty_dirs"}
+
+// migrations upgrade an index one schema version at a time, migrations[n] taking it from version n to n+1.
+// Add new tables and columns here instead of changing an existing migration.
+var migrations = []func(tx *sql.Tx) error{
+	// 1: Tables the updater keeps its own state in. Installs from before versioning may have some of these already.
+	func(tx *sql.Tx) error {
+		return execAll(tx,
+			// Values the updater keeps between runs
+			`CREATE TABLE IF NOT EXISTS updater_state (
+				key TEXT PRIMARY KEY,
+				value
+			)`,
+			// Files dropped by the last upgrade, waiting to be cleaned up
+			`CREATE TABLE IF NOT EXISTS removed_files (
+				path TEXT PRIMARY KEY,
+				size INTEGER
+			)`,
+			// Finished ranges of large files being downloaded in segments
+			`CREATE TABLE IF NOT EXISTS segments (
+				path TEXT,
+				segment INTEGER,
+				PRIMARY KEY (path, segment)
+			)`,
+			// Files which ran out of retries, and why
+			`CREATE TABLE IF NOT EXISTS failures (
+				path TEXT PRIMARY KEY,
+				error TEXT,
+				category TEXT,
+				attempts INTEGER,
+				failed_at INTEGER
+			)`,
+			// Older indexes were made before extra mirrors could be listed
+			`CREATE TABLE IF NOT EXISTS mirrors (
+				base_url TEXT PRIMARY KEY,
+				priority INTEGER
+			)`)
+	},
+}
+
 func OpenDatabase(filepath string) (*SqliteRepo, error) {
-	db, err := sql.Open("sqlite3", filepath+"?cache=shared")
+	// Write-ahead logging lets progress be committed without syncing the whole database each time. Changes are
+	// only lost if the system crashes before a checkpoint, and anything lost is checked again or downloaded.
+	db, err := sql.Open("sqlite3", filepath+"?cache=shared&_journal_mode=WAL&_synchronous=NORMAL")
 	if err != nil {
 		return nil, err
 	}
 	db.SetMaxOpenConns(1)
 
+	err = migrate(db)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
 	// Clear all taken markets
 	_, err = db.Exec("UPDATE files SET taken = false WHERE taken = true")
 	if err != nil {
+		_ = db.Close()
 		return nil, err
 	}
 
@@ -27,6 +84,97 @@ func OpenDatabase(filepath string) (*SqliteRepo, error) {
 	}, nil
 }
 
+// migrate brings an index up to the current schema version, refusing indexes made for a newer updater
+func migrate(db *sql.DB) error {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+	if version > schemaVersion {
+		return &UnsupportedSchema{Version: version, Supported: schemaVersion}
+	}
+	if version == 0 {
+		// Make sure it's an index at all before adding to it
+		for _, table := range indexTables {
+			var exists bool
+			err = db.QueryRow("SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = ?", table).
+				Scan(&exists)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return &InvalidIndex{MissingTable: table}
+			}
+		}
+	}
+
+	// Each step commits with its new version, so an interrupted upgrade continues from the last finished step
+	for ; version < schemaVersion; version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		err = migrations[version](tx)
+		if err == nil {
+			// Pragmas can't take parameters
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1))
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to upgrade index to schema version %d: %w", version+1, err)
+		}
+	}
+	return nil
+}
+
+// execAll runs each statement in order, stopping at the first error
+func execAll(tx *sql.Tx, statements ...string) error {
+	for _, statement := range statements {
+		_, err := tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameDatabase moves a database along with its write-ahead log, which can hold changes not yet in the database.
+// The shared memory index is rebuilt from the log, so it's removed instead.
+func renameDatabase(from string, to string) error {
+	err := removeDatabase(to)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(from, to)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(from+"-wal", to+"-wal")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(from + "-shm")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removeDatabase deletes a database and any write-ahead log left with it
+func removeDatabase(path string) error {
+	for _, p := range []string{path, path + "-wal", path + "-shm"} {
+		err := os.Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
 func (repo *SqliteRepo) GetOverview() (IndexOverview, error) {
 	var overview IndexOverview
 	err := repo.db.QueryRow("SELECT name, total_files, total_size, base_url FROM overview LIMIT 1").
@@ -57,11 +205,161 @@ func (repo *SqliteRepo) GetTotalDownladedFiles() (int64, error) {
 	return total, nil
 }
 
-func (repo *SqliteRepo) MarkFileDone(file *IndexedFile) error {
-	_, err := repo.db.Exec("UPDATE files SET done = true WHERE path = ?", file.Filepath)
+// GetFilesPage returns up to limit files after the given rowid, in rowid order, which are either done or not
+func (repo *SqliteRepo) GetFilesPage(done bool, afterRowid int64, limit int) ([]*IndexedFile, error) {
+	rows, err := repo.db.Query(`SELECT rowid, path, size, crc32 FROM files
+		WHERE done = ? AND rowid > ?
+		ORDER BY rowid
+		LIMIT ?`, done, afterRowid, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make([]*IndexedFile, 0)
+	for rows.Next() {
+		var f IndexedFile
+		err = rows.Scan(&f.rowid, &f.Filepath, &f.Size, &f.CRC32)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, &f)
+	}
+	return files, rows.Err()
+}
+
+// SetFilesDone sets the done state of many files in a single transaction
+func (repo *SqliteRepo) SetFilesDone(files []*IndexedFile, done bool) error {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("UPDATE files SET done = ? WHERE path = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	failureStmt, err := tx.Prepare("DELETE FROM failures WHERE path = ?")
+	if err != nil {
+		return err
+	}
+	defer failureStmt.Close()
+	for _, f := range files {
+		_, err = stmt.Exec(done, f.Filepath)
+		if err != nil {
+			return err
+		}
+		if done {
+			_, err = failureStmt.Exec(f.Filepath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (repo *SqliteRepo) CountFilesAfter(done bool, afterRowid int64) (int64, error) {
+	var total int64
+	err := repo.db.QueryRow("SELECT COUNT(*) FROM files WHERE done = ? AND rowid > ?", done, afterRowid).
+		Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// GetState scans a value saved with SetState into dest, returning false if it has not been set
+func (repo *SqliteRepo) GetState(key string, dest any) (bool, error) {
+	err := repo.db.QueryRow("SELECT value FROM updater_state WHERE key = ?", key).Scan(dest)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (repo *SqliteRepo) SetState(key string, value any) error {
+	_, err := repo.db.Exec("INSERT OR REPLACE INTO updater_state (key, value) VALUES (?, ?)", key, value)
+	return err
+}
+
+func (repo *SqliteRepo) DeleteState(key string) error {
+	_, err := repo.db.Exec("DELETE FROM updater_state WHERE key = ?", key)
+	return err
+}
+
+// CopyState copies the given keys from the updater state of the previous index at previousPath, replacing any here
+func (repo *SqliteRepo) CopyState(previousPath string, keys ...string) error {
+	_, err := repo.db.Exec("ATTACH DATABASE ? AS previous", previousPath)
+	if err != nil {
+		return err
+	}
+	defer repo.db.Exec("DETACH DATABASE previous")
+
+	var exists bool
+	err = repo.db.QueryRow("SELECT COUNT(*) > 0 FROM previous.sqlite_master WHERE type = 'table' AND name = 'updater_state'").Scan(&exists)
+	if err != nil || !exists {
+		return err
+	}
+	for _, key := range keys {
+		_, err = repo.db.Exec(`INSERT OR REPLACE INTO updater_state (key, value)
+			SELECT key, value FROM previous.updater_state WHERE key = ?`, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetDoneSegments returns the segments of a file already downloaded
+func (repo *SqliteRepo) GetDoneSegments(path string) (map[int64]bool, error) {
+	rows, err := repo.db.Query("SELECT segment FROM segments WHERE path = ?", path)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	done := make(map[int64]bool)
+	for rows.Next() {
+		var segment int64
+		err = rows.Scan(&segment)
+		if err != nil {
+			return nil, err
+		}
+		done[segment] = true
+	}
+	return done, rows.Err()
+}
+
+func (repo *SqliteRepo) MarkSegmentDone(path string, segment int64) error {
+	_, err := repo.db.Exec("INSERT OR IGNORE INTO segments (path, segment) VALUES (?, ?)", path, segment)
+	return err
+}
+
+func (repo *SqliteRepo) ClearSegments(path string) error {
+	_, err := repo.db.Exec("DELETE FROM segments WHERE path = ?", path)
 	return err
 }
 
+// GetQueuedFile returns a file from the index which is still to be downloaded, or nil if it isn't
+func (repo *SqliteRepo) GetQueuedFile(path string) (*IndexedFile, error) {
+	var f IndexedFile
+	err := repo.db.QueryRow("SELECT rowid, path, size, crc32 FROM files WHERE path = ? AND done = false", path).
+		Scan(&f.rowid, &f.Filepath, &f.Size, &f.CRC32)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
 func (repo *SqliteRepo) GetNextEmptyDir() (string, error) {
 	var d string
 	err := repo.db.QueryRow(`UPDATE empty_dirs SET done = true
@@ -81,53 +379,110 @@ func (repo *SqliteRepo) Close() error {
 	return err
 }
 
-func (repo *SqliteRepo) GetNextFile() (*IndexedFile, error) {
-	var f IndexedFile
-	f.RetryCount = 0
-	err := repo.db.QueryRow(`UPDATE files SET taken = true
-		WHERE rowid = (
-		    SELECT MIN(rowid)
-		    FROM files
-		    WHERE done = false AND taken = false
-		) RETURNING path, size, crc32`).Scan(&f.Filepath, &f.Size, &f.CRC32)
+// queueFilter restricts the files queued for download to those which failed last time, if asked
+func queueFilter(failedOnly bool) string {
+	if failedOnly {
+		return " AND path IN (SELECT path FROM failures)"
+	}
+	return ""
+}
+
+// TakeQueuedFiles returns up to limit files waiting to be downloaded after the given rowid, in rowid order,
+// marking them all taken in a single transaction
+func (repo *SqliteRepo) TakeQueuedFiles(afterRowid int64, limit int, failedOnly bool) ([]*IndexedFile, error) {
+	tx, err := repo.db.Begin()
 	if err != nil {
 		return nil, err
 	}
-	return &f, nil
-}
+	defer tx.Rollback()
 
-// GetNextFileBatch Cannot be safely executed in parallel
-func (repo *SqliteRepo) GetNextFileBatch(limit int64) ([]*IndexedFile, error) {
-	rows, err := repo.db.Query("SELECT path, size, crc32 FROM files WHERE done = false AND taken = false LIMIT ?", limit)
+	filter := "done = false AND taken = false" + queueFilter(failedOnly)
+	rows, err := tx.Query(`SELECT rowid, path, size, crc32 FROM files
+		WHERE `+filter+` AND rowid > ?
+		ORDER BY rowid
+		LIMIT ?`, afterRowid, limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	files := make([]*IndexedFile, 0)
+	files := make([]*IndexedFile, 0, limit)
 	for rows.Next() {
 		var f IndexedFile
-		f.RetryCount = 0
-		err = rows.Scan(&f.Filepath, &f.Size, &f.CRC32)
+		err = rows.Scan(&f.rowid, &f.Filepath, &f.Size, &f.CRC32)
 		if err != nil {
 			return nil, err
 		}
 		files = append(files, &f)
 	}
-
 	err = rows.Close()
 	if err != nil {
 		return nil, err
 	}
+	if len(files) == 0 {
+		return files, nil
+	}
 
-	for _, f := range files {
-		_, updateErr := repo.db.Exec("UPDATE files SET taken = true WHERE path = ?", f.Filepath)
-		if updateErr != nil {
-			// Handle the update error if needed
-			return nil, updateErr
+	// Every file in the range matching the filter was just read, so the whole page is taken at once
+	_, err = tx.Exec("UPDATE files SET taken = true WHERE "+filter+" AND rowid > ? AND rowid <= ?",
+		afterRowid, files[len(files)-1].rowid)
+	if err != nil {
+		return nil, err
+	}
+	return files, tx.Commit()
+}
+
+// CountQueuedFiles returns how many files are waiting to be downloaded and not already taken
+func (repo *SqliteRepo) CountQueuedFiles(failedOnly bool) (int64, error) {
+	var total int64
+	err := repo.db.QueryRow("SELECT COUNT(*) FROM files WHERE done = false AND taken = false" + queueFilter(failedOnly)).
+		Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// RecordFailure saves why a file ran out of retries, adding to the attempts of any earlier failure
+func (repo *SqliteRepo) RecordFailure(path string, message string, category string, attempts int, failedAt time.Time) error {
+	_, err := repo.db.Exec(`INSERT INTO failures (path, error, category, attempts, failed_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (path) DO UPDATE SET
+		    error = excluded.error,
+		    category = excluded.category,
+		    attempts = failures.attempts + excluded.attempts,
+		    failed_at = excluded.failed_at`, path, message, category, attempts, failedAt.Unix())
+	return err
+}
+
+// GetFailures returns every recorded failure, most recent first
+func (repo *SqliteRepo) GetFailures() ([]FailureRecord, error) {
+	rows, err := repo.db.Query("SELECT path, error, category, attempts, failed_at FROM failures ORDER BY failed_at DESC, path")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	failures := make([]FailureRecord, 0)
+	for rows.Next() {
+		var r FailureRecord
+		var failedAt int64
+		err = rows.Scan(&r.Path, &r.Error, &r.Category, &r.Attempts, &failedAt)
+		if err != nil {
+			return nil, err
 		}
+		r.FailedAt = time.Unix(failedAt, 0)
+		failures = append(failures, r)
+	}
+	return failures, rows.Err()
+}
+
+func (repo *SqliteRepo) CountFailures() (int64, error) {
+	var total int64
+	err := repo.db.QueryRow("SELECT COUNT(*) FROM failures").Scan(&total)
+	if err != nil {
+		return 0, err
 	}
-	return files, nil
+	return total, nil
 }
 
 func (repo *SqliteRepo) ResetDownloadState() error {
@@ -140,6 +495,10 @@ func (repo *SqliteRepo) ResetDownloadState() error {
 		return err
 	}
 	_, err = repo.db.Exec("UPDATE empty_dirs SET done = false")
+	if err != nil {
+		return err
+	}
+	_, err = repo.db.Exec("DELETE FROM failures")
 	return err
 }
 
@@ -148,7 +507,168 @@ func (repo *SqliteRepo) ClearTakenAll() error {
 	return err
 }
 
-func (repo *SqliteRepo) ClearTaken(f *IndexedFile) error {
-	_, err := repo.db.Exec("UPDATE files SET taken = false WHERE path = ?", f.Filepath)
+// GetChangedFiles returns paths that exist in both this and the previous index at previousPath, but with different contents
+func (repo *SqliteRepo) GetChangedFiles(previousPath string) ([]string, error) {
+	_, err := repo.db.Exec("ATTACH DATABASE ? AS previous", previousPath)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.db.Exec("DETACH DATABASE previous")
+
+	return repo.queryPaths(`SELECT files.path
+		FROM files
+		JOIN previous.files p ON p.path = files.path
+		WHERE p.size != files.size OR p.crc32 != files.crc32`)
+}
+
+// MarkUnchangedDone marks files as done when the previous index at previousPath had already downloaded them
+// with the same size and checksum, returning how many files were carried over
+func (repo *SqliteRepo) MarkUnchangedDone(previousPath string) (int64, error) {
+	_, err := repo.db.Exec("ATTACH DATABASE ? AS previous", previousPath)
+	if err != nil {
+		return 0, err
+	}
+	defer repo.db.Exec("DETACH DATABASE previous")
+
+	res, err := repo.db.Exec(`UPDATE files SET done = true
+		WHERE done = false AND EXISTS (
+		    SELECT 1
+		    FROM previous.files p
+		    WHERE p.path = files.path AND p.size = files.size AND p.crc32 = files.crc32 AND p.done = true
+		)`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// RecordRemovedFiles stores every path in the previous index at previousPath that no longer exists in this index,
+// including any still waiting to be cleaned up from an earlier upgrade. Returns how many were recorded.
+func (repo *SqliteRepo) RecordRemovedFiles(previousPath string) (int64, error) {
+	_, err := repo.db.Exec("ATTACH DATABASE ? AS previous", previousPath)
+	if err != nil {
+		return 0, err
+	}
+	defer repo.db.Exec("DETACH DATABASE previous")
+
+	// A path only changing case is the same file on Windows and macOS, so it mustn't be removed after downloading.
+	// NOCASE only folds ASCII letters, the paths are indexed into a temporary table so each lookup stays quick.
+	_, err = repo.db.Exec("CREATE TEMP TABLE index_paths (path TEXT PRIMARY KEY COLLATE NOCASE)")
+	if err != nil {
+		return 0, err
+	}
+	defer repo.db.Exec("DROP TABLE temp.index_paths")
+	_, err = repo.db.Exec("INSERT OR IGNORE INTO temp.index_paths (path) SELECT path FROM files")
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := repo.db.Exec(`INSERT OR IGNORE INTO removed_files (path, size)
+		SELECT p.path, p.size
+		FROM previous.files p
+		WHERE NOT EXISTS (SELECT 1 FROM temp.index_paths c WHERE c.path = p.path)`)
+	if err != nil {
+		return 0, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	// Carry over removed files the user hasn't cleaned up yet
+	var exists bool
+	err = repo.db.QueryRow("SELECT COUNT(*) > 0 FROM previous.sqlite_master WHERE type = 'table' AND name = 'removed_files'").
+		Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		res, err = repo.db.Exec(`INSERT OR IGNORE INTO removed_files (path, size)
+			SELECT p.path, p.size
+			FROM previous.removed_files p
+			WHERE NOT EXISTS (SELECT 1 FROM temp.index_paths c WHERE c.path = p.path)`)
+		if err != nil {
+			return 0, err
+		}
+		carried, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		count += carried
+	}
+	return count, nil
+}
+
+func (repo *SqliteRepo) GetRemovedFilesSummary() (int64, int64, error) {
+	var count, size int64
+	err := repo.db.QueryRow("SELECT COUNT(*), IFNULL(sum(size), 0) FROM removed_files").
+		Scan(&count, &size)
+	if err != nil {
+		return 0, 0, err
+	}
+	return count, size, nil
+}
+
+func (repo *SqliteRepo) GetRemovedFiles() ([]string, error) {
+	return repo.queryPaths("SELECT path FROM removed_files ORDER BY path")
+}
+
+func (repo *SqliteRepo) ClearRemovedFiles() error {
+	_, err := repo.db.Exec("DELETE FROM removed_files")
 	return err
 }
+
+func (repo *SqliteRepo) GetEmptyDirs() ([]string, error) {
+	return repo.queryPaths("SELECT path FROM empty_dirs")
+}
+
+// GetProbeFile returns the path of a file to request when testing mirrors, preferring one big enough to measure
+func (repo *SqliteRepo) GetProbeFile() (string, error) {
+	var path string
+	err := repo.db.QueryRow("SELECT path FROM files WHERE size >= ? LIMIT 1", mirrorProbeSize).Scan(&path)
+	if err == sql.ErrNoRows {
+		err = repo.db.QueryRow("SELECT path FROM files LIMIT 1").Scan(&path)
+	}
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// GetMirrors returns any extra base urls listed in the index, none for indexes made before mirrors could be listed
+func (repo *SqliteRepo) GetMirrors() ([]Mirror, error) {
+	rows, err := repo.db.Query("SELECT base_url, priority FROM mirrors ORDER BY priority")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	mirrors := make([]Mirror, 0)
+	for rows.Next() {
+		var m Mirror
+		err = rows.Scan(&m.BaseUrl, &m.Priority)
+		if err != nil {
+			return nil, err
+		}
+		mirrors = append(mirrors, m)
+	}
+	return mirrors, rows.Err()
+}
+
+func (repo *SqliteRepo) queryPaths(query string, args ...any) ([]string, error) {
+	rows, err := repo.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	paths := make([]string, 0)
+	for rows.Next() {
+		var p string
+		err = rows.Scan(&p)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+	return paths, rows.Err()
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// indexTableStatements create the tables of an index the way index.py does
+var indexTableStatements = map[string]string{
+	"overview":   "CREATE TABLE overview (name TEXT PRIMARY KEY, total_files INTEGER, total_size INTEGER, base_url TEXT)",
+	"files":      "CREATE TABLE files (path TEXT PRIMARY KEY, size INTEGER, crc32 INTEGER, taken INTEGER DEFAULT false, done INTEGER DEFAULT false)",
+	"empty_dirs": "CREATE TABLE empty_dirs (path TEXT PRIMARY KEY, done INTEGER DEFAULT false)",
+}
+
+// createIndex writes a database like index.py makes at the given schema version, leaving out any skipped tables
+func createIndex(t *testing.T, version int, skip ...string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "ultimate.sqlite")
+	db, err := sql.Open("sqlite3", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for name, statement := range indexTableStatements {
+		if containsString(skip, name) {
+			continue
+		}
+		_, err = db.Exec(statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.Exec(fmt.Sprintf("PRAGMA user_version = %d", version))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// writeIndex creates an index at p holding the given files, all still to be downloaded
+func writeIndex(t *testing.T, p string, baseUrl string, files ...*IndexedFile) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	for _, statement := range indexTableStatements {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := int64(0)
+	for _, f := range files {
+		size += f.Size
+		_, err = tx.Exec("INSERT INTO files (path, size, crc32) VALUES (?, ?, ?)", f.Filepath, f.Size, f.CRC32)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = tx.Exec("INSERT INTO overview VALUES (?, ?, ?, ?)", "Test", len(files), size, baseUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// openTestIndex creates and opens an index in a temporary folder holding the given files
+func openTestIndex(t *testing.T, baseUrl string, files ...*IndexedFile) *SqliteRepo {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "ultimate.sqlite")
+	writeIndex(t, p, baseUrl, files...)
+	repo, err := OpenDatabase(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = repo.Close()
+	})
+	return repo
+}
+
+// testFile returns an index entry matching the given contents
+func testFile(path string, data []byte) *IndexedFile {
+	return &IndexedFile{Filepath: path, Size: int64(len(data)), CRC32: int(crc32.ChecksumIEEE(data))}
+}
+
+// numberedFiles returns n index entries with distinct paths, in the order they're inserted
+func numberedFiles(n int) []*IndexedFile {
+	files := make([]*IndexedFile, n)
+	for i := range files {
+		files[i] = testFile(fmt.Sprintf("Data/f%05d.bin", i), []byte(fmt.Sprintf("file %d", i)))
+	}
+	return files
+}
+
+func schemaOf(t *testing.T, repo *SqliteRepo) int {
+	t.Helper()
+	var version int
+	err := repo.db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func countTaken(t *testing.T, repo *SqliteRepo) int {
+	t.Helper()
+	var taken int
+	err := repo.db.QueryRow("SELECT COUNT(*) FROM files WHERE taken = true").Scan(&taken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return taken
+}
+
+func TestOpenDatabaseMigrates(t *testing.T) {
+	p := createIndex(t, 0)
+	repo, err := OpenDatabase(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := schemaOf(t, repo); v != schemaVersion {
+		t.Errorf("user_version = %d, want %d", v, schemaVersion)
+	}
+	for _, table := range []string{"updater_state", "removed_files", "segments", "failures", "mirrors"} {
+		var exists bool
+		err = repo.db.QueryRow("SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&exists)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			t.Errorf("table %s missing after migrating", table)
+		}
+	}
+	err = repo.SetState("key", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = repo.Close()
+
+	// Opening an up to date index again keeps what's in it
+	repo, err = OpenDatabase(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	if v := schemaOf(t, repo); v != schemaVersion {
+		t.Errorf("user_version = %d after reopening, want %d", v, schemaVersion)
+	}
+	var value string
+	found, err := repo.GetState("key", &value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || value != "value" {
+		t.Errorf("state lost after reopening, got %q", value)
+	}
+}
+
+func TestOpenDatabaseRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		skip    []string
+		check   func(err error) bool
+	}{
+		{"newer schema", schemaVersion + 1, nil, func(err error) bool {
+			var unsupported *UnsupportedSchema
+			return errors.As(err, &unsupported) && unsupported.Version == schemaVersion+1 &&
+				unsupported.Supported == schemaVersion && brokenState(err) == err
+		}},
+		{"missing files table", 0, []string{"files"}, func(err error) bool {
+			var invalid *InvalidIndex
+			return errors.As(err, &invalid) && invalid.MissingTable == "files"
+		}},
+		{"missing empty dirs table", 0, []string{"empty_dirs"}, func(err error) bool {
+			var invalid *InvalidIndex
+			return errors.As(err, &invalid) && invalid.MissingTable == "empty_dirs"
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo, err := OpenDatabase(createIndex(t, test.version, test.skip...))
+			if err == nil {
+				_ = repo.Close()
+				t.Fatal("opened without an error")
+			}
+			if !test.check(err) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestTakeQueuedFilesPages(t *testing.T) {
+	files := numberedFiles(2500)
+	repo := openTestIndex(t, "http://localhost", files...)
+	// Some finished already, these are never handed out
+	err := repo.SetFilesDone(files[:10], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	after := int64(0)
+	pages := 0
+	for {
+		page, err := repo.TakeQueuedFiles(after, 1000, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		pages += 1
+		for _, f := range page {
+			if seen[f.Filepath] {
+				t.Fatalf("%s handed out twice", f.Filepath)
+			}
+			if f.rowid <= after {
+				t.Fatalf("%s out of order, rowid %d after %d", f.Filepath, f.rowid, after)
+			}
+			seen[f.Filepath] = true
+			after = f.rowid
+		}
+	}
+	if pages != 3 {
+		t.Errorf("read %d pages, want 3", pages)
+	}
+	if len(seen) != 2490 {
+		t.Errorf("handed out %d files, want 2490", len(seen))
+	}
+	for _, f := range files[:10] {
+		if seen[f.Filepath] {
+			t.Errorf("%s handed out though done", f.Filepath)
+		}
+	}
+	if taken := countTaken(t, repo); taken != 2490 {
+		t.Errorf("%d files taken, want 2490", taken)
+	}
+
+	// Taken files aren't handed out again, even reading from the start
+	page, err := repo.TakeQueuedFiles(0, 1000, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 0 {
+		t.Errorf("%d taken files handed out again", len(page))
+	}
+
+	// Everything not finished is given back
+	err = repo.SetFilesDone(files[10:20], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.ClearTakenAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taken := countTaken(t, repo); taken != 0 {
+		t.Errorf("%d files still taken after ClearTakenAll", taken)
+	}
+	queued, err := repo.CountQueuedFiles(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued != 2480 {
+		t.Errorf("%d files queued after giving back, want 2480", queued)
+	}
+}
+
+func TestTakeQueuedFilesFailedOnly(t *testing.T) {
+	files := numberedFiles(5)
+	repo := openTestIndex(t, "http://localhost", files...)
+	for _, f := range []*IndexedFile{files[1], files[3]} {
+		err := repo.RecordFailure(f.Filepath, "not found", ErrorNotFound.String(), 1, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	queued, err := repo.CountQueuedFiles(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued != 2 {
+		t.Errorf("%d failed files queued, want 2", queued)
+	}
+	page, err := repo.TakeQueuedFiles(0, 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || page[0].Filepath != files[1].Filepath || page[1].Filepath != files[3].Filepath {
+		t.Errorf("took %v, want only the failed files", page)
+	}
+	// Files between the failed ones aren't marked taken with the page
+	if taken := countTaken(t, repo); taken != 2 {
+		t.Errorf("%d files taken, want 2", taken)
+	}
+}
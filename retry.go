@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultMaxRetries is how many times a file is retried before failing unless configured otherwise
+	defaultMaxRetries = 5
+	// defaultMaxRetryDelay caps the wait between retries unless configured otherwise
+	defaultMaxRetryDelay = time.Minute
+	// retryBaseDelay is the wait before the first retry, doubling for each retry after
+	retryBaseDelay = time.Second
+	// maxRetryAfter is the longest a server can ask us to wait with Retry-After
+	maxRetryAfter = 10 * time.Minute
+)
+
+// RetryPolicy decides how often and how long to wait before downloading a failed file again
+type RetryPolicy struct {
+	MaxRetries int
+	MaxDelay   time.Duration
+}
+
+// retryPolicy creates a policy from the config, using the defaults for 0. Negative retries disable retrying.
+func retryPolicy(maxRetries int, maxDelaySeconds int) RetryPolicy {
+	p := RetryPolicy{
+		MaxRetries: maxRetries,
+		MaxDelay:   time.Duration(maxDelaySeconds) * time.Second,
+	}
+	if p.MaxRetries == 0 {
+		p.MaxRetries = defaultMaxRetries
+	} else if p.MaxRetries < 0 {
+		p.MaxRetries = 0
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaultMaxRetryDelay
+	}
+	return p
+}
+
+// Delay returns how long to wait before the given retry, starting from 1. The wait doubles each retry up to
+// MaxDelay, with up to half of it randomised so files failing together don't all retry at the same moment.
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < retry && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// RetryAfter returns the wait before the given retry, waiting longer if the server asked for it
+func (p RetryPolicy) RetryAfter(retry int, err error) time.Duration {
+	delay := p.Delay(retry)
+	var busy *ServerBusy
+	if errors.As(err, &busy) && busy.RetryAfter > delay {
+		delay = busy.RetryAfter
+	}
+	return delay
+}
+
+// parseRetryAfter reads a Retry-After header given as either seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	var after time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		after = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		after = date.Sub(now)
+	} else {
+		return 0, false
+	}
+	if after < 0 {
+		after = 0
+	}
+	if after > maxRetryAfter {
+		after = maxRetryAfter
+	}
+	return after, true
+}
+
+// checkServerBusy wraps err with the server's Retry-After when it responded 429 or 503
+func checkServerBusy(err error, resp *http.Response) error {
+	if err == nil || resp == nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return err
+	}
+	after, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if !ok {
+		return err
+	}
+	return &ServerBusy{err: err, RetryAfter: after}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"soon", 0, false},
+		{"30", 30 * time.Second, true},
+		{" 5 ", 5 * time.Second, true},
+		{"-10", 0, true},
+		{"3600", maxRetryAfter, true},
+		{"Fri, 01 Mar 2024 12:02:00 GMT", 2 * time.Minute, true},
+		{"Fri, 01 Mar 2024 11:00:00 GMT", 0, true},
+		{"Sat, 02 Mar 2024 12:00:00 GMT", maxRetryAfter, true},
+	}
+	for _, test := range tests {
+		got, ok := parseRetryAfter(test.value, now)
+		if got != test.want || ok != test.ok {
+			t.Errorf("parseRetryAfter(%q) = %s, %t, want %s, %t", test.value, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	tests := []struct {
+		maxRetries int
+		maxDelay   int
+		want       RetryPolicy
+	}{
+		{0, 0, RetryPolicy{MaxRetries: defaultMaxRetries, MaxDelay: defaultMaxRetryDelay}},
+		{3, 10, RetryPolicy{MaxRetries: 3, MaxDelay: 10 * time.Second}},
+		{-1, -5, RetryPolicy{MaxRetries: 0, MaxDelay: defaultMaxRetryDelay}},
+	}
+	for _, test := range tests {
+		got := retryPolicy(test.maxRetries, test.maxDelay)
+		if got != test.want {
+			t.Errorf("retryPolicy(%d, %d) = %+v, want %+v", test.maxRetries, test.maxDelay, got, test.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := RetryPolicy{MaxRetries: 10, MaxDelay: 10 * time.Second}
+	tests := []struct {
+		retry int
+		full  time.Duration // The wait before randomising, the result is between half and all of it
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{20, 10 * time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 50; i++ {
+			got := p.Delay(test.retry)
+			if got < test.full/2 || got > test.full {
+				t.Fatalf("Delay(%d) = %s, want between %s and %s", test.retry, got, test.full/2, test.full)
+			}
+		}
+	}
+}
+
+func TestRetryAfterServerBusy(t *testing.T) {
+	p := RetryPolicy{MaxRetries: 5, MaxDelay: 10 * time.Second}
+	busy := &ServerBusy{err: errors.New("busy"), RetryAfter: time.Minute}
+	if got := p.RetryAfter(1, busy); got != time.Minute {
+		t.Errorf("RetryAfter with Retry-After of a minute = %s", got)
+	}
+	// A server asking for less than the backoff doesn't shorten it
+	busy.RetryAfter = time.Millisecond
+	if got := p.RetryAfter(1, busy); got < 500*time.Millisecond {
+		t.Errorf("RetryAfter with a short Retry-After = %s, want at least the backoff", got)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileCheck is the result of comparing a file on disk against the index
+type FileCheck int
+
+const (
+	FileOk FileCheck = iota
+	FileMissing
+	FileWrongSize
+	FileCorrupt
+	FileUnreadable
+)
+
+// scanPageSize is how many files are loaded from the index at a time while scanning
+const scanPageSize = 1000
+
+// adoptScanKey stores the last rowid checked by an unfinished adopt scan
+const adoptScanKey = "adopt_scan_rowid"
+
+// checkFile compares the file under root against the size and CRC32 recorded in the index
+func checkFile(root string, f *IndexedFile) FileCheck {
+	p := filepath.Join(root, f.Filepath)
+	info, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return FileMissing
+		}
+		return FileUnreadable
+	}
+	if info.IsDir() {
+		return FileMissing
+	}
+	if info.Size() != f.Size {
+		return FileWrongSize
+	}
+
+	file, err := os.Open(p)
+	if err != nil {
+		return FileUnreadable
+	}
+	defer file.Close()
+	hash := crc32.NewIEEE()
+	_, err = io.CopyBuffer(hash, file, make([]byte, 64*1024))
+	if err != nil {
+		return FileUnreadable
+	}
+	if int(hash.Sum32()) != f.CRC32 {
+		return FileCorrupt
+	}
+	return FileOk
+}
+
+// scanFiles pages through the index after afterRowid, checking each file with a pool of workers.
+// onResult is called on the calling goroutine for every file, and onPage once every file in a page has a result.
+// Stops early without error if the context is cancelled, in which case onPage is not called for the unfinished page.
+func scanFiles(ctx context.Context, nextPage func(afterRowid int64) ([]*IndexedFile, error), afterRowid int64, workers int,
+	check func(f *IndexedFile) FileCheck, onResult func(f *IndexedFile, result FileCheck), onPage func(lastRowid int64) error) error {
+	type scanResult struct {
+		file    *IndexedFile
+		result  FileCheck
+		skipped bool
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+	filech := make(chan *IndexedFile)
+	resultch := make(chan *scanResult)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range filech {
+				if ctx.Err() != nil {
+					// Drain the rest of the page quickly
+					resultch <- &scanResult{file: f, skipped: true}
+					continue
+				}
+				resultch <- &scanResult{file: f, result: check(f)}
+			}
+		}()
+	}
+	defer func() {
+		close(filech)
+		wg.Wait()
+	}()
+
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		files, err := nextPage(afterRowid)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return nil
+		}
+
+		// Feed the page to the workers while collecting results
+		go func() {
+			for _, f := range files {
+				filech <- f
+			}
+		}()
+		for range files {
+			r := <-resultch
+			if !r.skipped {
+				onResult(r.file, r.result)
+			}
+		}
+		if ctx.Err() != nil {
+			// Page is incomplete, don't record it
+			return nil
+		}
+
+		afterRowid = files[len(files)-1].rowid
+		err = onPage(afterRowid)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// VerifyProgress summarises a verify pass
+type VerifyProgress struct {
+	Total      int64
+	Checked    int64
+	Missing    int64
+	Corrupt    int64
+	Unreadable int64
+}
+
+// Fraction returns how much of the verify pass is complete, between 0 and 1
+func (p VerifyProgress) Fraction() float64 {
+	if p.Total == 0 {
+		return 0
+	}
+	return float64(p.Checked) / float64(p.Total)
+}
+
+func (p VerifyProgress) String() string {
+	s := fmt.Sprintf("Checked %s / %s files, %s missing, %s corrupt",
+		humanize.Comma(p.Checked), humanize.Comma(p.Total), humanize.Comma(p.Missing), humanize.Comma(p.Corrupt))
+	if p.Unreadable > 0 {
+		s += fmt.Sprintf(", %s unreadable", humanize.Comma(p.Unreadable))
+	}
+	return s
+}
+
+// verifyFiles checks every downloaded file on disk against the index without using the network.
+// Files which are missing or damaged are marked as not done, so the next Resume downloads only those.
+// Progress is reported at most a few times a second, and once more when finished.
+func verifyFiles(ctx context.Context, repo *SqliteRepo, installPath string, workers int, onProgress func(VerifyProgress)) (VerifyProgress, error) {
+	var progress VerifyProgress
+	total, err := repo.GetTotalDownladedFiles()
+	if err != nil {
+		return progress, err
+	}
+	progress.Total = total
+	onProgress(progress)
+
+	damaged := make([]*IndexedFile, 0)
+	lastReport := time.Now()
+	err = scanFiles(ctx,
+		func(afterRowid int64) ([]*IndexedFile, error) {
+			return repo.GetFilesPage(true, afterRowid, scanPageSize)
+		}, 0, workers,
+		func(f *IndexedFile) FileCheck {
+			return checkFile(installPath, f)
+		},
+		func(f *IndexedFile, result FileCheck) {
+			progress.Checked += 1
+			switch result {
+			case FileMissing:
+				progress.Missing += 1
+				damaged = append(damaged, f)
+			case FileWrongSize, FileCorrupt:
+				progress.Corrupt += 1
+				damaged = append(damaged, f)
+			case FileUnreadable:
+				progress.Unreadable += 1
+			}
+			if time.Since(lastReport) > 250*time.Millisecond {
+				lastReport = time.Now()
+				onProgress(progress)
+			}
+		},
+		func(lastRowid int64) error {
+			// Requeue damaged files from this page
+			if len(damaged) == 0 {
+				return nil
+			}
+			err := repo.SetFilesDone(damaged, false)
+			damaged = damaged[:0]
+			return err
+		})
+	if err != nil {
+		return progress, err
+	}
+
+	// Requeue anything found before being cancelled
+	if len(damaged) > 0 {
+		err = repo.SetFilesDone(damaged, false)
+	}
+	onProgress(progress)
+	return progress, err
+}
+
+// AdoptProgress summarises a scan for files already present in the install folder
+type AdoptProgress struct {
+	Total   int64
+	Checked int64
+	Found   int64
+}
+
+// Fraction returns how much of the scan is complete, between 0 and 1
+func (p AdoptProgress) Fraction() float64 {
+	if p.Total == 0 {
+		return 0
+	}
+	return float64(p.Checked) / float64(p.Total)
+}
+
+func (p AdoptProgress) String() string {
+	return fmt.Sprintf("Checked %s / %s files, %s already downloaded",
+		humanize.Comma(p.Checked), humanize.Comma(p.Total), humanize.Comma(p.Found))
+}
+
+// hasExistingFiles reports whether the install folder holds anything other than the updater's own files
+func hasExistingFiles(installPath string) (bool, error) {
+	entries, err := os.ReadDir(installPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, e := range entries {
+		switch e.Name() {
+		case "ultimate.sqlite", "ultimate.sqlite-wal", "ultimate.sqlite-shm", "ultimate-previous.sqlite",
+			"ultimate-previous.sqlite-wal", "ultimate-previous.sqlite-shm", "ultimate.sqlite.download", pendingJournal, partialDir:
+			continue
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// prepareAdoptScan flags a newly downloaded index to be compared against files already in the install folder.
+// Returns false if the folder has nothing to compare against.
+func prepareAdoptScan(installPath string) (bool, error) {
+	existing, err := hasExistingFiles(installPath)
+	if err != nil || !existing {
+		return false, err
+	}
+	repo, err := OpenDatabase(filepath.Join(installPath, "ultimate.sqlite"))
+	if err != nil {
+		return false, err
+	}
+	defer repo.Close()
+	err = repo.SetState(adoptScanKey, int64(0))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func adoptScanPending(repo *SqliteRepo) (bool, error) {
+	var rowid int64
+	return repo.GetState(adoptScanKey, &rowid)
+}
+
+// adoptFiles marks files already in the install folder with a matching size and CRC32 as done, so they are not
+// downloaded again. Progress is saved after every page, so an interrupted scan continues where it left off.
+func adoptFiles(ctx context.Context, repo *SqliteRepo, installPath string, workers int, onProgress func(AdoptProgress)) (AdoptProgress, error) {
+	var progress AdoptProgress
+	var afterRowid int64
+	pending, err := repo.GetState(adoptScanKey, &afterRowid)
+	if err != nil || !pending {
+		return progress, err
+	}
+	total, err := repo.CountFilesAfter(false, afterRowid)
+	if err != nil {
+		return progress, err
+	}
+	progress.Total = total
+	onProgress(progress)
+
+	found := make([]*IndexedFile, 0)
+	lastReport := time.Now()
+	err = scanFiles(ctx,
+		func(afterRowid int64) ([]*IndexedFile, error) {
+			return repo.GetFilesPage(false, afterRowid, scanPageSize)
+		}, afterRowid, workers,
+		func(f *IndexedFile) FileCheck {
+			return checkFile(installPath, f)
+		},
+		func(f *IndexedFile, result FileCheck) {
+			progress.Checked += 1
+			if result == FileOk {
+				progress.Found += 1
+				found = append(found, f)
+			}
+			if time.Since(lastReport) > 250*time.Millisecond {
+				lastReport = time.Now()
+				onProgress(progress)
+			}
+		},
+		func(lastRowid int64) error {
+			if len(found) > 0 {
+				err := repo.SetFilesDone(found, true)
+				if err != nil {
+					return err
+				}
+				found = found[:0]
+			}
+			return repo.SetState(adoptScanKey, lastRowid)
+		})
+	if err != nil {
+		return progress, err
+	}
+
+	// Keep anything found before being cancelled, the rest of the page is checked again next time
+	if len(found) > 0 {
+		err = repo.SetFilesDone(found, true)
+		if err != nil {
+			return progress, err
+		}
+	}
+	onProgress(progress)
+	if ctx.Err() != nil {
+		return progress, nil
+	}
+	return progress, repo.DeleteState(adoptScanKey)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyFiles(t *testing.T) {
+	ok := testFile("Data/ok.bin", []byte("intact"))
+	missing := testFile("Data/missing.bin", []byte("deleted since"))
+	wrongSize := testFile("Data/wrong-size.bin", []byte("cut short later"))
+	corrupt := testFile("Data/corrupt.bin", []byte("same length"))
+	// Its folder is a file now, so it can't be looked at
+	unreadable := testFile("Data/blocked/unreadable.bin", []byte("can't be checked"))
+	notDone := testFile("Data/not-done.bin", []byte("never downloaded"))
+	repo := openTestIndex(t, "http://localhost", ok, missing, wrongSize, corrupt, unreadable, notDone)
+	err := repo.SetFilesDone([]*IndexedFile{ok, missing, wrongSize, corrupt, unreadable}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	installPath := t.TempDir()
+	writeInstalled(t, installPath, ok.Filepath, []byte("intact"))
+	writeInstalled(t, installPath, wrongSize.Filepath, []byte("cut"))
+	writeInstalled(t, installPath, corrupt.Filepath, []byte("SAME LENGTH"))
+	writeInstalled(t, installPath, "Data/blocked", []byte("in the way"))
+
+	progress, err := verifyFiles(context.Background(), repo, installPath, 2, func(VerifyProgress) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := VerifyProgress{Total: 5, Checked: 5, Missing: 1, Corrupt: 2, Unreadable: 1}
+	if progress != want {
+		t.Errorf("finished with %+v, want %+v", progress, want)
+	}
+	// Only files known to be gone or damaged are downloaded again
+	tests := []struct {
+		file   *IndexedFile
+		queued bool
+	}{
+		{ok, false},
+		{missing, true},
+		{wrongSize, true},
+		{corrupt, true},
+		{unreadable, false},
+		{notDone, true},
+	}
+	for _, test := range tests {
+		if got := isQueued(t, repo, test.file.Filepath); got != test.queued {
+			t.Errorf("%s queued = %t, want %t", test.file.Filepath, got, test.queued)
+		}
+	}
+}
+
+func TestAdoptFilesResumes(t *testing.T) {
+	installPath := t.TempDir()
+	files := numberedFiles(scanPageSize*2 + 10)
+	writeIndex(t, filepath.Join(installPath, "ultimate.sqlite"), "http://localhost", files...)
+	// Every third file is already there, one more is there with the wrong contents
+	present := make(map[string]bool)
+	for i := 0; i < len(files); i += 3 {
+		writeInstalled(t, installPath, files[i].Filepath, []byte(fmt.Sprintf("file %d", i)))
+		present[files[i].Filepath] = true
+	}
+	writeInstalled(t, installPath, files[1].Filepath, []byte("something else"))
+
+	pending, err := prepareAdoptScan(installPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pending {
+		t.Fatal("no scan prepared for a folder with files in it")
+	}
+	repo, err := OpenDatabase(filepath.Join(installPath, "ultimate.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	// Cancelled before anything is checked, the scan is still pending
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	progress, err := adoptFiles(ctx, repo, installPath, 2, func(AdoptProgress) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Checked != 0 {
+		t.Errorf("checked %d files after cancelling", progress.Checked)
+	}
+	if pending, err := adoptScanPending(repo); err != nil || !pending {
+		t.Fatalf("scan pending = %t, %v after cancelling, want still pending", pending, err)
+	}
+
+	// As if an earlier run was interrupted after the first page, which is not checked again
+	err = repo.SetState(adoptScanKey, int64(scanPageSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress, err = adoptFiles(context.Background(), repo, installPath, 2, func(AdoptProgress) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest := files[scanPageSize:]
+	found := int64(0)
+	for _, f := range rest {
+		if present[f.Filepath] {
+			found += 1
+		}
+	}
+	want := AdoptProgress{Total: int64(len(rest)), Checked: int64(len(rest)), Found: found}
+	if progress != want {
+		t.Errorf("finished with %+v, want %+v", progress, want)
+	}
+	for i, f := range files {
+		wantQueued := i < scanPageSize || !present[f.Filepath]
+		if got := isQueued(t, repo, f.Filepath); got != wantQueued {
+			t.Errorf("%s queued = %t, want %t", f.Filepath, got, wantQueued)
+		}
+	}
+	if pending, err := adoptScanPending(repo); err != nil || pending {
+		t.Errorf("scan pending = %t, %v after finishing", pending, err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScheduleSlot overrides the speed limit between two times of day. Slots ending before they start run past midnight.
+type ScheduleSlot struct {
+	Start string `json:"start"` // Time of day as HH:MM
+	End   string `json:"end"`
+	Limit int    `json:"limit"` // KB/s, 0 for unlimited
+	Pause bool   `json:"pause"`
+}
+
+// parseTimeOfDay returns the minutes since midnight of a HH:MM time
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains reports whether the slot applies at the given time
+func (s ScheduleSlot) Contains(now time.Time) bool {
+	start, err := parseTimeOfDay(s.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseTimeOfDay(s.End)
+	if err != nil {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// String formats the slot the same way parseScheduleSlot reads it
+func (s ScheduleSlot) String() string {
+	if s.Pause {
+		return fmt.Sprintf("%s-%s pause", s.Start, s.End)
+	}
+	return fmt.Sprintf("%s-%s %d", s.Start, s.End, s.Limit)
+}
+
+// Describe returns the slot's effect for showing beside the speed limit
+func (s ScheduleSlot) Describe() string {
+	if s.Pause {
+		return fmt.Sprintf("Paused until %s (schedule)", s.End)
+	}
+	if s.Limit == 0 {
+		return fmt.Sprintf("Unlimited until %s (schedule)", s.End)
+	}
+	return fmt.Sprintf("%dKB/s until %s (schedule)", s.Limit, s.End)
+}
+
+func validateScheduleSlot(s ScheduleSlot) error {
+	_, err := parseTimeOfDay(s.Start)
+	if err != nil {
+		return err
+	}
+	_, err = parseTimeOfDay(s.End)
+	if err != nil {
+		return err
+	}
+	if s.Start == s.End {
+		return fmt.Errorf("schedule slot %s starts and ends at the same time", s.String())
+	}
+	if s.Limit < 0 {
+		return fmt.Errorf("schedule slot %s has a negative limit", s.String())
+	}
+	return nil
+}
+
+// validateSchedule checks every slot in a schedule loaded from config
+func validateSchedule(slots []ScheduleSlot) error {
+	for _, s := range slots {
+		err := validateScheduleSlot(s)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseScheduleSlot reads a slot written as "HH:MM-HH:MM <KB/s>" or "HH:MM-HH:MM pause"
+func parseScheduleSlot(line string) (ScheduleSlot, error) {
+	var slot ScheduleSlot
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return slot, fmt.Errorf("invalid schedule line %q, expected HH:MM-HH:MM followed by a limit in KB/s or pause", line)
+	}
+	times := strings.SplitN(fields[0], "-", 2)
+	if len(times) != 2 {
+		return slot, fmt.Errorf("invalid schedule times %q, expected HH:MM-HH:MM", fields[0])
+	}
+	slot.Start = times[0]
+	slot.End = times[1]
+	if strings.EqualFold(fields[1], "pause") {
+		slot.Pause = true
+	} else {
+		limit, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return slot, fmt.Errorf("invalid schedule limit %q, expected KB/s or pause", fields[1])
+		}
+		slot.Limit = limit
+	}
+	return slot, validateScheduleSlot(slot)
+}
+
+// parseSchedule reads one slot per line, ignoring blank lines
+func parseSchedule(text string) ([]ScheduleSlot, error) {
+	slots := make([]ScheduleSlot, 0)
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		slot, err := parseScheduleSlot(line)
+		if err != nil {
+			return nil, err
+		}
+		slots = append(slots, slot)
+	}
+	return slots, nil
+}
+
+// formatSchedule writes one slot per line, the reverse of parseSchedule
+func formatSchedule(slots []ScheduleSlot) string {
+	lines := make([]string, len(slots))
+	for i, s := range slots {
+		lines[i] = s.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// activeScheduleSlot returns the first slot applying at the given time, if any
+func activeScheduleSlot(slots []ScheduleSlot, now time.Time) *ScheduleSlot {
+	for i := range slots {
+		if slots[i].Contains(now) {
+			return &slots[i]
+		}
+	}
+	return nil
+}
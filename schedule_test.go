@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleSlot(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    ScheduleSlot
+		wantErr bool
+	}{
+		{"09:00-18:00 2048", ScheduleSlot{Start: "09:00", End: "18:00", Limit: 2048}, false},
+		{"23:30-00:30 pause", ScheduleSlot{Start: "23:30", End: "00:30", Pause: true}, false},
+		{"  01:00-02:00   PAUSE ", ScheduleSlot{Start: "01:00", End: "02:00", Pause: true}, false},
+		{"00:00-06:00 0", ScheduleSlot{Start: "00:00", End: "06:00", Limit: 0}, false},
+		{"09:00-18:00", ScheduleSlot{}, true},
+		{"09:00 18:00 100", ScheduleSlot{}, true},
+		{"09:00-18:00 fast", ScheduleSlot{}, true},
+		{"25:00-18:00 100", ScheduleSlot{}, true},
+		{"09:00-09:00 100", ScheduleSlot{}, true},
+		{"09:00-18:00 -1", ScheduleSlot{}, true},
+	}
+	for _, test := range tests {
+		got, err := parseScheduleSlot(test.line)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseScheduleSlot(%q) = %+v, want an error", test.line, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseScheduleSlot(%q) failed: %v", test.line, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseScheduleSlot(%q) = %+v, want %+v", test.line, got, test.want)
+		}
+	}
+}
+
+func TestParseScheduleRoundTrip(t *testing.T) {
+	text := "09:00-18:00 2048\n\n23:30-00:30 pause\n"
+	slots, err := parseSchedule(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slots) != 2 {
+		t.Fatalf("parsed %d slots, want 2", len(slots))
+	}
+	want := "09:00-18:00 2048\n23:30-00:30 pause"
+	if got := formatSchedule(slots); got != want {
+		t.Errorf("formatSchedule = %q, want %q", got, want)
+	}
+}
+
+func TestScheduleSlotContains(t *testing.T) {
+	day := ScheduleSlot{Start: "09:00", End: "18:00"}
+	overnight := ScheduleSlot{Start: "23:30", End: "00:30"}
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2024, 3, 1, hour, minute, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name string
+		slot ScheduleSlot
+		now  time.Time
+		want bool
+	}{
+		{"before day", day, at(8, 59), false},
+		{"day start", day, at(9, 0), true},
+		{"during day", day, at(12, 0), true},
+		{"day end", day, at(18, 0), false},
+		{"before midnight", overnight, at(23, 29), false},
+		{"overnight start", overnight, at(23, 30), true},
+		{"midnight", overnight, at(0, 0), true},
+		{"after midnight", overnight, at(0, 29), true},
+		{"overnight end", overnight, at(0, 30), false},
+		{"midday", overnight, at(12, 0), false},
+	}
+	for _, test := range tests {
+		if got := test.slot.Contains(test.now); got != test.want {
+			t.Errorf("%s: %s Contains(%s) = %t, want %t", test.name, test.slot, test.now.Format("15:04"), got, test.want)
+		}
+	}
+}
+
+func TestActiveScheduleSlot(t *testing.T) {
+	slots := []ScheduleSlot{
+		{Start: "22:00", End: "02:00", Pause: true},
+		{Start: "00:00", End: "06:00", Limit: 100},
+	}
+	// The first matching slot wins where they overlap
+	got := activeScheduleSlot(slots, time.Date(2024, 3, 1, 1, 0, 0, 0, time.Local))
+	if got != &slots[0] {
+		t.Errorf("at 01:00 got %v, want the pause slot", got)
+	}
+	got = activeScheduleSlot(slots, time.Date(2024, 3, 1, 3, 0, 0, 0, time.Local))
+	if got != &slots[1] {
+		t.Errorf("at 03:00 got %v, want the limit slot", got)
+	}
+	got = activeScheduleSlot(slots, time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local))
+	if got != nil {
+		t.Errorf("at 12:00 got %v, want no slot", got)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SeedProgress summarises copying files from another local copy of the install
+type SeedProgress struct {
+	Total      int64
+	Checked    int64
+	Copied     int64
+	CopiedSize int64
+	Failed     int64
+}
+
+// Fraction returns how much of the seed folder has been checked, between 0 and 1
+func (p SeedProgress) Fraction() float64 {
+	if p.Total == 0 {
+		return 0
+	}
+	return float64(p.Checked) / float64(p.Total)
+}
+
+func (p SeedProgress) String() string {
+	s := fmt.Sprintf("Checked %s / %s files, copied %s (%s)",
+		humanize.Comma(p.Checked), humanize.Comma(p.Total), humanize.Comma(p.Copied), FormatBytes(p.CopiedSize))
+	if p.Failed > 0 {
+		s += fmt.Sprintf(", %s failed to copy", humanize.Comma(p.Failed))
+	}
+	return s
+}
+
+// seedFile copies or hardlinks a verified file from the seed folder into the install folder.
+// Hardlinks fall back to copying when the folders are on different filesystems.
+// Like a download it's staged first and moved into place once complete, so a failed copy never replaces a file.
+func seedFile(seedPath string, installPath string, f *IndexedFile, hardlink bool) error {
+	src := filepath.Join(seedPath, f.Filepath)
+	dst := partialPath(installPath, f.Filepath)
+	err := os.MkdirAll(filepath.Dir(dst), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	// Replace any partial download
+	err = os.Remove(dst)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if hardlink {
+		err = os.Link(src, dst)
+		if err == nil {
+			// Already on disk as the seed copy, and may not be writable to sync
+			return placePartial(installPath, f)
+		}
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyBuffer(out, in, make([]byte, 64*1024))
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+	return finishPartial(installPath, f)
+}
+
+// seedFiles looks for every file still to be downloaded under seedPath, copying across any with a matching
+// size and CRC32 and marking them done. Files missing or different in the seed folder are left for download.
+func seedFiles(ctx context.Context, repo *SqliteRepo, installPath string, seedPath string, hardlink bool, workers int, onProgress func(SeedProgress)) (SeedProgress, error) {
+	var progress SeedProgress
+	absInstall, err := filepath.Abs(installPath)
+	if err != nil {
+		return progress, err
+	}
+	absSeed, err := filepath.Abs(seedPath)
+	if err != nil {
+		return progress, err
+	}
+	if absInstall == absSeed {
+		return progress, errors.New("seed folder must be different to the install folder")
+	}
+	info, err := os.Stat(absSeed)
+	if err != nil {
+		return progress, err
+	}
+	if !info.IsDir() {
+		return progress, fmt.Errorf("%s is not a folder", absSeed)
+	}
+
+	total, err := repo.CountFilesAfter(false, 0)
+	if err != nil {
+		return progress, err
+	}
+	progress.Total = total
+	onProgress(progress)
+
+	copied := make([]*IndexedFile, 0)
+	lastReport := time.Now()
+	err = scanFiles(ctx,
+		func(afterRowid int64) ([]*IndexedFile, error) {
+			return repo.GetFilesPage(false, afterRowid, scanPageSize)
+		}, 0, workers,
+		func(f *IndexedFile) FileCheck {
+			result := checkFile(absSeed, f)
+			if result != FileOk {
+				return result
+			}
+			err := seedFile(absSeed, absInstall, f, hardlink)
+			if err != nil {
+				return FileUnreadable
+			}
+			return FileOk
+		},
+		func(f *IndexedFile, result FileCheck) {
+			progress.Checked += 1
+			switch result {
+			case FileOk:
+				progress.Copied += 1
+				progress.CopiedSize += f.Size
+				copied = append(copied, f)
+			case FileUnreadable:
+				progress.Failed += 1
+			}
+			if time.Since(lastReport) > 250*time.Millisecond {
+				lastReport = time.Now()
+				onProgress(progress)
+			}
+		},
+		func(lastRowid int64) error {
+			if len(copied) == 0 {
+				return nil
+			}
+			err := syncParents(absInstall, copied)
+			if err != nil {
+				return err
+			}
+			err = repo.SetFilesDone(copied, true)
+			copied = copied[:0]
+			return err
+		})
+	if err != nil {
+		return progress, err
+	}
+
+	// Keep anything copied before being cancelled
+	if len(copied) > 0 {
+		err = syncParents(absInstall, copied)
+		if err == nil {
+			err = repo.SetFilesDone(copied, true)
+		}
+	}
+	// Tidy away the folders copies were staged in
+	if err == nil {
+		err = cleanPartials(repo, absInstall)
+	}
+	onProgress(progress)
+	return progress, err
+}
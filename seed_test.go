@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSeedFiles(t *testing.T) {
+	for _, hardlink := range []bool{false, true} {
+		name := "copy"
+		if hardlink {
+			name = "hardlink"
+		}
+		t.Run(name, func(t *testing.T) {
+			matching := testFile("Data/sub/matching.bin", []byte("same in both"))
+			different := testFile("Data/different.bin", []byte("newer contents"))
+			absent := testFile("Data/absent.bin", []byte("not in the seed"))
+			repo := openTestIndex(t, "http://localhost", matching, different, absent)
+			installPath := t.TempDir()
+			seedPath := t.TempDir()
+			writeInstalled(t, seedPath, matching.Filepath, []byte("same in both"))
+			writeInstalled(t, seedPath, different.Filepath, []byte("older contents"))
+
+			progress, err := seedFiles(context.Background(), repo, installPath, seedPath, hardlink, 2, func(SeedProgress) {})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := SeedProgress{Total: 3, Checked: 3, Copied: 1, CopiedSize: matching.Size}
+			if progress != want {
+				t.Errorf("finished with %+v, want %+v", progress, want)
+			}
+			got, err := os.ReadFile(filepath.Join(installPath, matching.Filepath))
+			if err != nil || !bytes.Equal(got, []byte("same in both")) {
+				t.Errorf("matching file not seeded: %q, %v", got, err)
+			}
+			if _, err := os.Stat(filepath.Join(installPath, different.Filepath)); !os.IsNotExist(err) {
+				t.Errorf("file differing from the index seeded: %v", err)
+			}
+			tests := []struct {
+				file   *IndexedFile
+				queued bool
+			}{
+				{matching, false},
+				{different, true},
+				{absent, true},
+			}
+			for _, test := range tests {
+				if got := isQueued(t, repo, test.file.Filepath); got != test.queued {
+					t.Errorf("%s queued = %t, want %t", test.file.Filepath, got, test.queued)
+				}
+			}
+		})
+	}
+}
+
+func TestSeedFilesRejectsInstallFolder(t *testing.T) {
+	repo := openTestIndex(t, "http://localhost", numberedFiles(1)...)
+	installPath := t.TempDir()
+	_, err := seedFiles(context.Background(), repo, installPath, filepath.Join(installPath, "."), false, 1, func(SeedProgress) {})
+	if err == nil {
+		t.Error("seeded an install from itself")
+	}
+}
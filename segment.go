@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cavaliergopher/grab/v3"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// segmentSize is how much of a large file each ranged request fetches
+	segmentSize = 32 * 1024 * 1024
+	// defaultSegmentThreshold is the smallest file downloaded in segments unless configured otherwise
+	defaultSegmentThreshold = 512 * 1024 * 1024
+)
+
+// ErrNoRangeSupport is returned when a server sends the whole file instead of the requested range
+var ErrNoRangeSupport = errors.New("server does not support range requests")
+
+// ErrBadRange is returned when a server sends a different part of the file than was requested
+var ErrBadRange = errors.New("server sent the wrong range")
+
+// segmentThreshold converts the configured threshold in MB to bytes, using the default for 0 and disabling for -1
+func segmentThreshold(mb int) int64 {
+	if mb == 0 {
+		return defaultSegmentThreshold
+	}
+	if mb < 0 {
+		return 0
+	}
+	return int64(mb) * 1024 * 1024
+}
+
+// segmentRange returns the first and last byte of a segment
+func segmentRange(size int64, segment int64) (int64, int64) {
+	start := segment * segmentSize
+	end := start + segmentSize - 1
+	if end >= size {
+		end = size - 1
+	}
+	return start, end
+}
+
+// downloadSegmented fetches a large file as several ranges at once, spread over the mirrors.
+// Finished segments are saved to the repo, so an interrupted download only fetches what's missing.
+// Each range holds a slot in the concurrency gate while it downloads, the same as a whole file.
+func (d *Downloader) downloadSegmented(f *IndexedFile) {
+	d.emit(&FileStartedEvent{File: f})
+
+	dest := partialPath(d.installPath, f.Filepath)
+	file, err := d.openSegmentedFile(f, dest)
+	if err != nil {
+		d.retryOrFail(f, err)
+		return
+	}
+	done, err := d.repo.GetDoneSegments(f.Filepath)
+	if err != nil {
+		_ = file.Close()
+		d.emit(&FatalErrorEvent{&DatabaseError{err}})
+		d.releaseFile(f)
+		return
+	}
+
+	segments := (f.Size + segmentSize - 1) / segmentSize
+	pending := make([]int64, 0, segments)
+	complete := int64(0)
+	for i := int64(0); i < segments; i++ {
+		if done[i] {
+			start, end := segmentRange(f.Size, i)
+			complete += end - start + 1
+		} else {
+			pending = append(pending, i)
+		}
+	}
+
+	// One failed segment stops the rest, the file is retried as a whole and resumes from the finished segments
+	ctx, cancel := context.WithCancel(d.ctx)
+	defer cancel()
+	var failure error
+	var failureOnce sync.Once
+	segmentch := make(chan int64)
+	go func() {
+		defer close(segmentch)
+		for _, segment := range pending {
+			select {
+			case <-ctx.Done():
+				return
+			case segmentch <- segment:
+			}
+		}
+	}()
+
+	workers := d.workers
+	if workers > len(pending) {
+		workers = len(pending)
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for segment := range segmentch {
+				// Each segment is a connection, counted against the same limit as whole files
+				d.gate.Acquire(ctx)
+				if ctx.Err() != nil {
+					d.gate.Release()
+					return
+				}
+				err := d.downloadSegment(ctx, f, file, segment, &complete)
+				d.gate.Release()
+				if err == nil {
+					err = d.repo.MarkSegmentDone(f.Filepath, segment)
+					if err != nil {
+						err = &DatabaseError{err}
+					}
+				}
+				if err != nil {
+					failureOnce.Do(func() {
+						failure = err
+						cancel()
+					})
+					return
+				}
+			}
+		}()
+	}
+
+	// Report progress while the segments download
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	t := time.NewTicker(500 * time.Millisecond)
+	defer t.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-t.C:
+			bytes := atomic.LoadInt64(&complete)
+			d.updatech <- &Update{
+				IndexFile: f,
+				Progress:  float64(bytes) / float64(f.Size),
+				Bytes:     bytes,
+				Done:      false,
+			}
+		case <-finished:
+			waiting = false
+		}
+	}
+
+	err = file.Close()
+	if d.ctx.Err() != nil {
+		d.releaseFile(f)
+		return
+	}
+	if failure == nil && err != nil {
+		failure = err
+	}
+	if errors.Is(failure, ErrNoRangeSupport) {
+		d.downloadWhole(f, dest, failure)
+		return
+	}
+	if failure != nil {
+		d.retryOrFail(f, failure)
+		return
+	}
+
+	// Segments can come from different mirrors, so check the whole file once they're all here
+	if checkFile(filepath.Join(d.installPath, partialDir), f) != FileOk {
+		_ = os.Remove(dest)
+		err = d.repo.ClearSegments(f.Filepath)
+		if err != nil {
+			d.emit(&FatalErrorEvent{&DatabaseError{err}})
+		}
+		d.retryOrFail(f, grab.ErrBadChecksum)
+		return
+	}
+	err = finishPartial(d.installPath, f)
+	if err != nil {
+		d.retryOrFail(f, err)
+		return
+	}
+	err = d.repo.ClearSegments(f.Filepath)
+	if err != nil {
+		d.emit(&FatalErrorEvent{&DatabaseError{err}})
+	}
+	d.updatech <- &Update{
+		IndexFile:       f,
+		Retry:           false,
+		RemoveTakenFlag: false,
+		Failure:         nil,
+		Progress:        1,
+		Bytes:           f.Size,
+		Done:            true,
+	}
+}
+
+// downloadWhole gives up on segments for a file whose server ignores ranges, queueing it again as a single request.
+// The half written file is thrown away, it's full size so it would otherwise look finished.
+func (d *Downloader) downloadWhole(f *IndexedFile, dest string, reason error) {
+	_ = os.Remove(dest)
+	err := d.repo.ClearSegments(f.Filepath)
+	if err != nil {
+		d.emit(&FatalErrorEvent{&DatabaseError{err}})
+	}
+	f.whole = true
+	d.updatech <- &Update{
+		IndexFile:       f,
+		Retry:           true,
+		Requeue:         true,
+		RemoveTakenFlag: false,
+		Failure:         reason,
+		Progress:        1,
+		Bytes:           0,
+		Done:            true,
+	}
+}
+
+// openSegmentedFile opens the destination at its full size, forgetting finished segments if the file has gone
+func (d *Downloader) openSegmentedFile(f *IndexedFile, dest string) (*os.File, error) {
+	_, err := os.Stat(dest)
+	if os.IsNotExist(err) {
+		err = d.repo.ClearSegments(f.Filepath)
+		if err != nil {
+			return nil, &DatabaseError{err}
+		}
+	}
+	err = os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = file.Truncate(f.Size)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// downloadSegment fetches one segment, moving on to another mirror each time one fails
+func (d *Downloader) downloadSegment(ctx context.Context, f *IndexedFile, file *os.File, segment int64, complete *int64) error {
+	tried := make([]string, 0)
+	for {
+		mirror := d.mirrors.Pick(tried)
+		start := time.Now()
+		written, err := d.fetchSegment(ctx, mirror, f, file, segment, complete)
+		if err == nil {
+			d.reportNetwork(nil)
+			d.mirrors.ReportSuccess(mirror, written, time.Since(start))
+			return nil
+		}
+		// Start the segment again from the beginning
+		atomic.AddInt64(complete, -written)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, ErrNoRangeSupport) {
+			// The server answered fine, it just can't do this, so the file is downloaded whole instead
+			d.reportNetwork(nil)
+			return err
+		}
+		d.reportNetwork(err)
+		category := classifyError(err)
+		if category.Local() || (category.Network() && d.network.Waiting()) {
+			return err
+		}
+		if d.mirrors.ReportFailure(mirror) {
+			d.emit(&MirrorDisabledEvent{BaseUrl: mirror, Until: time.Now().Add(mirrorDisableTime)})
+		}
+		tried = append(tried, mirror)
+		if !d.mirrors.CanFailover(tried) {
+			return err
+		}
+	}
+}
+
+// fetchSegment requests a segment's range from a mirror and writes it into place, returning how many bytes were written
+func (d *Downloader) fetchSegment(ctx context.Context, mirror string, f *IndexedFile, file *os.File, segment int64, complete *int64) (int64, error) {
+	start, end := segmentRange(f.Size, segment)
+	// Cancelled on its own if the body stops arriving
+	reqCtx, reqCancel := context.WithCancel(ctx)
+	defer reqCancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, fmt.Sprintf("%s/%s", mirror, f.Filepath), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if d.client.UserAgent != "" {
+		req.Header.Set("User-Agent", d.client.UserAgent)
+	}
+	resp, err := d.client.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return 0, ErrNoRangeSupport
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, checkServerBusy(grab.StatusCodeError(resp.StatusCode), resp)
+	}
+	if !contentRangeMatches(resp.Header.Get("Content-Range"), start, end, f.Size) {
+		return 0, ErrBadRange
+	}
+
+	written := int64(0)
+	offset := start
+	buf := make([]byte, d.bufferSize)
+	// Only time the reads, so waiting on the speed limit or a pause doesn't count as stalling
+	idle := time.AfterFunc(d.Timeouts.Idle, reqCancel)
+	defer idle.Stop()
+	for offset <= end {
+		idle.Reset(d.Timeouts.Idle)
+		n, err := resp.Body.Read(buf)
+		if !idle.Stop() && ctx.Err() == nil {
+			return written, ErrStalled
+		}
+		if int64(n) > end-offset+1 {
+			n = int(end - offset + 1)
+		}
+		if n > 0 {
+			waitErr := d.limiter.WaitN(ctx, n)
+			if waitErr != nil {
+				return written, waitErr
+			}
+			_, writeErr := file.WriteAt(buf[:n], offset)
+			if writeErr != nil {
+				return written, writeErr
+			}
+			offset += int64(n)
+			written += int64(n)
+			atomic.AddInt64(complete, int64(n))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	if offset <= end {
+		return written, io.ErrUnexpectedEOF
+	}
+	return written, nil
+}
+
+// contentRangeMatches reports whether a Content-Range header starts at the requested byte and covers the whole range.
+// A longer range is fine as only the requested part is read, but the total must match the indexed size if given.
+func contentRangeMatches(header string, start int64, end int64, size int64) bool {
+	var gotStart, gotEnd int64
+	var total string
+	_, err := fmt.Sscanf(header, "bytes %d-%d/%s", &gotStart, &gotEnd, &total)
+	if err != nil {
+		return false
+	}
+	if gotStart != start || gotEnd < end {
+		return false
+	}
+	return total == "*" || total == strconv.FormatInt(size, 10)
+}
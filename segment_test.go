@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSegmentRange(t *testing.T) {
+	tests := []struct {
+		size    int64
+		segment int64
+		start   int64
+		end     int64
+	}{
+		{segmentSize * 3, 0, 0, segmentSize - 1},
+		{segmentSize * 3, 1, segmentSize, segmentSize*2 - 1},
+		{segmentSize * 3, 2, segmentSize * 2, segmentSize*3 - 1},
+		{segmentSize*2 + 1, 2, segmentSize * 2, segmentSize * 2},
+		{segmentSize + 100, 1, segmentSize, segmentSize + 99},
+		{100, 0, 0, 99},
+	}
+	for _, test := range tests {
+		start, end := segmentRange(test.size, test.segment)
+		if start != test.start || end != test.end {
+			t.Errorf("segmentRange(%d, %d) = %d-%d, want %d-%d", test.size, test.segment, start, end, test.start, test.end)
+		}
+	}
+}
+
+func TestSegmentThreshold(t *testing.T) {
+	tests := []struct {
+		mb   int
+		want int64
+	}{
+		{0, defaultSegmentThreshold},
+		{-1, 0},
+		{64, 64 * 1024 * 1024},
+	}
+	for _, test := range tests {
+		if got := segmentThreshold(test.mb); got != test.want {
+			t.Errorf("segmentThreshold(%d) = %d, want %d", test.mb, got, test.want)
+		}
+	}
+}
+
+func TestContentRangeMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		start  int64
+		end    int64
+		size   int64
+		want   bool
+	}{
+		{"bytes 0-99/1000", 0, 99, 1000, true},
+		{"bytes 100-199/1000", 100, 199, 1000, true},
+		{"bytes 100-199/*", 100, 199, 1000, true},
+		{"bytes 100-999/1000", 100, 199, 1000, true},
+		{"bytes 0-999/1000", 100, 199, 1000, false},
+		{"bytes 101-199/1000", 100, 199, 1000, false},
+		{"bytes 100-198/1000", 100, 199, 1000, false},
+		{"bytes 100-199/2000", 100, 199, 1000, false},
+		{"", 100, 199, 1000, false},
+		{"bytes */1000", 100, 199, 1000, false},
+		{"items 100-199/1000", 100, 199, 1000, false},
+	}
+	for _, test := range tests {
+		got := contentRangeMatches(test.header, test.start, test.end, test.size)
+		if got != test.want {
+			t.Errorf("contentRangeMatches(%q, %d, %d, %d) = %t, want %t", test.header, test.start, test.end, test.size, got, test.want)
+		}
+	}
+}
+
+// largeTestFile returns contents spanning two segments, the second only partly
+func largeTestFile() []byte {
+	data := make([]byte, segmentSize+segmentSize/4)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func TestDownloadSegmentedResumes(t *testing.T) {
+	data := largeTestFile()
+	ranges := make([]string, 0)
+	mu := sync.Mutex{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		http.ServeContent(w, r, "large.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+	f := testFile("Data/large.bin", data)
+	repo := openTestIndex(t, server.URL, f)
+	installPath := t.TempDir()
+
+	// The first segment finished last time
+	partial := make([]byte, len(data))
+	copy(partial, data[:segmentSize])
+	writeInstalled(t, installPath, filepath.Join(partialDir, f.Filepath), partial)
+	err := repo.MarkSegmentDone(f.Filepath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	progress := runDownloader(t, repo, installPath, func(d *Downloader) {
+		d.SegmentThreshold = 1
+	})
+	if progress.DownloadedFiles != 1 || progress.Failures != 0 {
+		t.Fatalf("finished with %d downloaded and %d failed", progress.DownloadedFiles, progress.Failures)
+	}
+	if len(ranges) != 1 || ranges[0] != "bytes=33554432-41943039" {
+		t.Errorf("requested ranges %v, want only the second segment", ranges)
+	}
+	got, err := os.ReadFile(filepath.Join(installPath, f.Filepath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded with the wrong contents")
+	}
+	done, err := repo.GetDoneSegments(f.Filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 0 {
+		t.Errorf("segments still recorded after finishing: %v", done)
+	}
+}
+
+func TestDownloadSegmentedWithoutRangeSupport(t *testing.T) {
+	data := largeTestFile()
+	// Always sends the whole file, whatever was asked for
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+	f := testFile("Data/large.bin", data)
+	repo := openTestIndex(t, server.URL, f)
+	installPath := t.TempDir()
+
+	var d *Downloader
+	progress := runDownloader(t, repo, installPath, func(downloader *Downloader) {
+		d = downloader
+		d.SegmentThreshold = 1
+	})
+	if progress.DownloadedFiles != 1 || progress.Failures != 0 {
+		t.Fatalf("finished with %d downloaded and %d failed", progress.DownloadedFiles, progress.Failures)
+	}
+	got, err := os.ReadFile(filepath.Join(installPath, f.Filepath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded with the wrong contents")
+	}
+	for _, s := range d.MirrorStats() {
+		if s.Failures != 0 {
+			t.Errorf("mirror %s counted %d failures for not supporting ranges", s.BaseUrl, s.Failures)
+		}
+	}
+}
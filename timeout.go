@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultConnectTimeout = 15 * time.Second
+	defaultTLSTimeout     = 15 * time.Second
+	// defaultIdleTimeout is how long a transfer can go without receiving anything before it's retried
+	defaultIdleTimeout = 30 * time.Second
+)
+
+// ErrStalled is returned when a transfer stops receiving data for longer than the idle timeout
+var ErrStalled = errors.New("transfer stalled, no data received")
+
+// Timeouts limits how long each stage of a request can take
+type Timeouts struct {
+	Connect      time.Duration
+	TLSHandshake time.Duration
+	Idle         time.Duration // Waiting for response headers or the next bytes of the body
+}
+
+// timeoutsFromConfig converts timeouts configured in seconds, using the defaults for 0
+func timeoutsFromConfig(connectSeconds int, tlsSeconds int, idleSeconds int) Timeouts {
+	t := Timeouts{
+		Connect:      time.Duration(connectSeconds) * time.Second,
+		TLSHandshake: time.Duration(tlsSeconds) * time.Second,
+		Idle:         time.Duration(idleSeconds) * time.Second,
+	}
+	if t.Connect <= 0 {
+		t.Connect = defaultConnectTimeout
+	}
+	if t.TLSHandshake <= 0 {
+		t.TLSHandshake = defaultTLSTimeout
+	}
+	if t.Idle <= 0 {
+		t.Idle = defaultIdleTimeout
+	}
+	return t
+}
+
+// newHTTPClient creates a client for downloading with the given timeouts. There's no overall timeout since
+// large files can take as long as they need, stalled bodies are caught by the downloader instead.
+func newHTTPClient(t Timeouts) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   t.Connect,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   t.TLSHandshake,
+			ResponseHeaderTimeout: t.Idle,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   maxWorkers,
+		},
+	}
+}
+
+// stallTimeout returns how long a transfer can go without progress before it's considered stalled.
+// At a low speed limit a transfer can wait its turn behind every other worker, so it's given longer.
+func (d *Downloader) stallTimeout() time.Duration {
+	timeout := d.Timeouts.Idle
+	if rate := d.limiter.Rate(); rate > 0 {
+		wait := time.Duration(float64(d.bufferSize*d.workers*2) / float64(rate) * float64(time.Second))
+		if wait > timeout {
+			timeout = wait
+		}
+	}
+	return timeout
+}
+
+// stallWatch tracks the bytes received by a transfer to notice when it stops making progress
+type stallWatch struct {
+	bytes        int64
+	lastProgress time.Time
+}
+
+func newStallWatch() *stallWatch {
+	return &stallWatch{lastProgress: time.Now()}
+}
+
+// Stalled records the bytes received so far, returning true if nothing has arrived within timeout.
+// Time spent paused doesn't count, since no transfer can make progress then.
+func (w *stallWatch) Stalled(bytes int64, paused bool, timeout time.Duration) bool {
+	now := time.Now()
+	if bytes != w.bytes || paused {
+		w.bytes = bytes
+		w.lastProgress = now
+		return false
+	}
+	return now.Sub(w.lastProgress) > timeout
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStallWatch(t *testing.T) {
+	timeout := 50 * time.Millisecond
+	w := newStallWatch()
+	if w.Stalled(0, false, timeout) {
+		t.Fatal("stalled straight away")
+	}
+
+	// Time spent paused doesn't count towards the timeout
+	time.Sleep(2 * timeout)
+	if w.Stalled(0, true, timeout) {
+		t.Error("stalled while paused")
+	}
+	if w.Stalled(0, false, timeout) {
+		t.Error("stalled straight after unpausing")
+	}
+
+	time.Sleep(2 * timeout)
+	if !w.Stalled(0, false, timeout) {
+		t.Error("not stalled after the timeout without progress")
+	}
+	if w.Stalled(10, false, timeout) {
+		t.Error("stalled after receiving more")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/data/binding"
@@ -16,10 +17,28 @@ type UiFile struct {
 }
 
 type IndexedFile struct {
-	Filepath   string `json:"path"`
-	Size       int64  `json:"size"`
-	CRC32      int    `json:"crc32"`
-	RetryCount int
+	Filepath     string `json:"path"`
+	Size         int64  `json:"size"`
+	CRC32        int    `json:"crc32"`
+	RetryCount   int
+	rowid        int64
+	mirror       string   // Base url of the current request
+	triedMirrors []string // Mirrors which failed since the last counted retry
+	whole        bool     // Download in one request even if large, set when a server ignores ranges
+	cancel       context.CancelFunc
+}
+
+// FailureRecord is a file which ran out of retries, kept in the repo until it downloads successfully
+type FailureRecord struct {
+	Path     string
+	Error    string
+	Category string
+	Attempts int64
+	FailedAt time.Time
+}
+
+func (r FailureRecord) String() string {
+	return fmt.Sprintf("%s | %s | %d attempts | %s", r.Path, r.Category, r.Attempts, r.FailedAt.Format("2006-01-02 15:04:05"))
 }
 
 type IndexOverview struct {
@@ -30,13 +49,49 @@ type IndexOverview struct {
 }
 
 type Config struct {
-	MetaUrl string `json:"meta_url"`
+	MetaUrl        string         `json:"meta_url"`
+	Workers        int            `json:"workers"`
+	Schedule       []ScheduleSlot `json:"schedule"`
+	SessionQuotaGB float64        `json:"session_quota_gb"`
+	MonthlyQuotaGB float64        `json:"monthly_quota_gb"`
+	// SegmentThresholdMB is the smallest file downloaded in parallel segments, 0 for the default or -1 to disable
+	SegmentThresholdMB int `json:"segment_threshold_mb"`
+	// MaxRetries is how many times a failed file is retried, 0 for the default or -1 to never retry
+	MaxRetries int `json:"max_retries"`
+	// MaxRetryDelaySeconds caps the wait between retries, 0 for the default
+	MaxRetryDelaySeconds int `json:"max_retry_delay_seconds"`
+	// Timeouts in seconds for connecting, the TLS handshake, and receiving nothing during a transfer, 0 for the defaults
+	ConnectTimeoutSeconds int `json:"connect_timeout_seconds"`
+	TLSTimeoutSeconds     int `json:"tls_timeout_seconds"`
+	IdleTimeoutSeconds    int `json:"idle_timeout_seconds"`
+	// AdaptiveWorkers tunes the files downloaded at once between MinWorkers and MaxWorkers, 0 for the defaults
+	AdaptiveWorkers bool `json:"adaptive_workers"`
+	MinWorkers      int  `json:"min_workers"`
+	MaxWorkers      int  `json:"max_workers"`
+}
+
+const (
+	// defaultWorkers is how many files are downloaded at once unless configured otherwise
+	defaultWorkers = 4
+	maxWorkers     = 64
+)
+
+// clampWorkers keeps a worker count within the supported range, using the default when unset
+func clampWorkers(n int) int {
+	if n <= 0 {
+		return defaultWorkers
+	}
+	if n > maxWorkers {
+		return maxWorkers
+	}
+	return n
 }
 
 type Meta struct {
 	Current   string   `json:"current"`
 	Path      string   `json:"path"`
 	Available []string `json:"available"`
+	Mirrors   []Mirror `json:"mirrors"`
 }
 
 type InstallerState struct {
@@ -49,13 +104,6 @@ type InstallerState struct {
 	window                 fyne.Window
 	folderPath             binding.String
 	installName            binding.String
-	totalFiles             int64
-	totalSize              int64
-	downloadedSize         int64
-	downloadedFiles        int64
-	downloadSpeed          float64
-	downloadFailures       int64
-	baseUrl                string
 	runningLabel           binding.String
 	formatDownloadedFiles  binding.String
 	formatDownloadedSize   binding.String
@@ -64,16 +112,18 @@ type InstallerState struct {
 	formatDownloadSpeed    binding.String
 	formatDownloadFailures binding.String
 	progressBarTotal       binding.Float
-	fileProgress1          binding.Float
-	fileProgress2          binding.Float
-	fileProgress3          binding.Float
-	fileProgress4          binding.Float
-	fileTitle1             binding.String
-	fileTitle2             binding.String
-	fileTitle3             binding.String
-	fileTitle4             binding.String
+	fileProgresses         []binding.Float
+	fileTitles             []binding.String
+	workers                int
+	adaptive               AdaptiveWorkers
+	formatWorkers          binding.String
+	workersEntry           binding.String
 	rateLimitEntry         binding.String
 	formatRateLimit        binding.String
+	formatSchedule         binding.String
+	schedule               []ScheduleSlot
+	sessionQuotaGB         float64
+	monthlyQuotaGB         float64
 	resumable              bool
 }
 
@@ -91,12 +141,57 @@ func (e *BrokenResumableState) Error() string {
 	return fmt.Sprintf("Broken resumable state found, must use a new index\n%s", e.err.Error())
 }
 
+// brokenState wraps an error opening an install's index. An index made for a newer updater isn't broken,
+// so that's returned as it is.
+func brokenState(err error) error {
+	var unsupported *UnsupportedSchema
+	if errors.As(err, &unsupported) {
+		return err
+	}
+	return &BrokenResumableState{err}
+}
+
 type DownloadFailure struct {
-	err error
+	err      error
+	retries  int
+	category ErrorCategory
 }
 
 func (e *DownloadFailure) Error() string {
-	return fmt.Sprintf("Download failure after 5 retries, retry later.\n%s", e.err.Error())
+	if e.category.Permanent() {
+		return fmt.Sprintf("Download failure (%s), not retrying.\n%s", e.category, e.err.Error())
+	}
+	return fmt.Sprintf("Download failure (%s) after %d retries, retry later.\n%s", e.category, e.retries, e.err.Error())
+}
+
+func (e *DownloadFailure) Unwrap() error {
+	return e.err
+}
+
+type DiskFull struct {
+	err error
+}
+
+func (e *DiskFull) Error() string {
+	return fmt.Sprintf("Disk full, downloading paused. Free up some space and start again.\n%s", e.err.Error())
+}
+
+func (e *DiskFull) Unwrap() error {
+	return e.err
+}
+
+// ServerBusy is a failed request where the server said how long to wait before trying again
+type ServerBusy struct {
+	err        error
+	RetryAfter time.Duration
+}
+
+func (e *ServerBusy) Error() string {
+	return fmt.Sprintf("%s (server asked to retry after %s)", e.err.Error(), e.RetryAfter)
+}
+
+func (e *ServerBusy) Unwrap() error {
+	return e.err
 }
 
 type FatalDownloadFailure struct {
@@ -115,12 +210,44 @@ func (e *DatabaseError) Error() string {
 	return fmt.Sprintf("Fatal database error\n%s", e.err.Error())
 }
 
+// UnsupportedSchema is an index made for a newer version of the updater than this one
+type UnsupportedSchema struct {
+	Version   int
+	Supported int
+}
+
+func (e *UnsupportedSchema) Error() string {
+	return fmt.Sprintf("This install uses index schema version %d, but this updater only supports up to version %d.\nDownload the latest updater to continue.",
+		e.Version, e.Supported)
+}
+
+// InvalidIndex is a database which isn't an updater index
+type InvalidIndex struct {
+	MissingTable string
+}
+
+func (e *InvalidIndex) Error() string {
+	return fmt.Sprintf("Not a valid install index, the %s table is missing", e.MissingTable)
+}
+
 type BadRateLimit struct{}
 
 func (e *BadRateLimit) Error() string {
 	return "Invalid rate limit"
 }
 
+type BadQuota struct{}
+
+func (e *BadQuota) Error() string {
+	return "Invalid quota, must be a number of GB or empty for no limit"
+}
+
+type BadWorkerCount struct{}
+
+func (e *BadWorkerCount) Error() string {
+	return fmt.Sprintf("Invalid number of downloads, must be between 1 and %d", maxWorkers)
+}
+
 type ConfigError struct {
 	err error
 }
@@ -143,14 +270,14 @@ func (e *VersionTooOld) Error() string {
 	return "Current version too old, you must upgrade to continue install"
 }
 
-type DownloadRateLimiter struct {
-	rate  int
-	total int64
+type QuotaReached struct {
+	Monthly bool
+	Limit   int64
 }
 
-func (c *DownloadRateLimiter) WaitN(_ context.Context, bytes int) (err error) {
-	c.total += int64(bytes)
-	time.Sleep(
-		time.Duration(1.00 / float64(c.rate) * float64(bytes) * float64(time.Second)))
-	return
+func (e *QuotaReached) Error() string {
+	if e.Monthly {
+		return fmt.Sprintf("Monthly data quota of %s reached", FormatBytes(e.Limit))
+	}
+	return fmt.Sprintf("Session data quota of %s reached", FormatBytes(e.Limit))
 }
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/data/binding"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"github.com/dustin/go-humanize"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// uiListener reflects downloader events into the window bindings and dialogs
+type uiListener struct {
+	state   *InstallerState
+	uifiles []*UiFile
+}
+
+func newUiListener(state *InstallerState) *uiListener {
+	l := &uiListener{
+		state: state,
+	}
+	l.resetFiles()
+	return l
+}
+
+// resetFiles creates an empty UI file for each active file slot
+func (l *uiListener) resetFiles() {
+	l.uifiles = make([]*UiFile, len(l.state.fileTitles))
+	for idx := range l.uifiles {
+		l.uifiles[idx] = &UiFile{
+			Filepath: "",
+			Progress: 0,
+			Done:     true,
+		}
+		l.setFileBinding(idx, "None", 0)
+	}
+}
+
+func (l *uiListener) HandleDownloadEvent(event DownloadEvent) {
+	switch e := event.(type) {
+	case *RunningEvent:
+		if e.Running {
+			_ = l.state.runningLabel.Set("Running")
+			_ = l.state.formatDownloadFailures.Set("0")
+			// Number of slots may have changed while stopped
+			l.resetFiles()
+		} else {
+			_ = l.state.runningLabel.Set("Stopped")
+		}
+	case *FileStartedEvent:
+		l.updateFile(e.File, 0, false)
+	case *FileProgressEvent:
+		l.updateFile(e.File, e.Progress, false)
+	case *FileDoneEvent:
+		l.updateFile(e.File, 1, true)
+		setProgressBindings(l.state, e.Progress)
+	case *FileFailedEvent:
+		l.updateFile(e.File, 1, true)
+		_ = l.state.formatDownloadFailures.Set(humanize.Comma(e.Progress.Failures))
+	case *SpeedEvent:
+		_ = l.state.formatDownloadSpeed.Set(FormatBytes(int64(e.BytesPerSecond)) + "/s")
+	case *ConcurrencyEvent:
+		_ = l.state.formatWorkers.Set(l.state.adaptive.Describe(e.Target))
+	case *ScheduleEvent:
+		if e.Slot == nil {
+			_ = l.state.formatSchedule.Set("")
+		} else {
+			_ = l.state.formatSchedule.Set(e.Slot.Describe())
+		}
+	case *QuotaReachedEvent:
+		promptContinuePastQuota(l.state, e.Err)
+	case *NetworkEvent:
+		if e.Waiting {
+			_ = l.state.runningLabel.Set("Waiting for network...")
+		} else {
+			_ = l.state.runningLabel.Set("Running")
+		}
+	case *DiskFullEvent:
+		dialog.NewError(e.Err, l.state.window).Show()
+	case *FinishedEvent:
+		if e.Progress.Failures > 0 {
+			dialog.NewInformation("Finished", fmt.Sprintf("Install finished with %d failures, you will have to press start again to retry these failed files.", e.Progress.Failures), l.state.window).Show()
+		} else {
+			d := dialog.NewInformation("Finished", "Install finished with no failures", l.state.window)
+			if e.Progress.DownloadedFiles == e.Progress.TotalFiles {
+				d.SetOnClosed(func() {
+					promptRemoveDroppedFiles(l.state)
+				})
+			}
+			d.Show()
+		}
+	case *FatalErrorEvent:
+		dialog.NewError(e.Err, l.state.window).Show()
+	}
+}
+
+func (l *uiListener) updateFile(f *IndexedFile, progress float64, done bool) {
+	if len(l.uifiles) != len(l.state.fileTitles) {
+		l.resetFiles()
+	}
+	updateIdx := -1
+	for idx, uf := range l.uifiles {
+		if uf.Filepath == f.Filepath {
+			updateIdx = idx
+			break
+		}
+	}
+	if updateIdx == -1 {
+		// Didn't find existing entry, find an older one to replace
+		for idx, uf := range l.uifiles {
+			if uf.Done {
+				updateIdx = idx
+				break
+			}
+		}
+	}
+	// If found a ui file, update element
+	if updateIdx != -1 {
+		uf := l.uifiles[updateIdx]
+		uf.Filepath = f.Filepath
+		uf.Progress = progress
+		uf.Done = done
+		l.setFileBinding(updateIdx, f.Filepath, progress)
+	}
+}
+
+func (l *uiListener) setFileBinding(idx int, title string, progress float64) {
+	_ = l.state.fileTitles[idx].Set(title)
+	_ = l.state.fileProgresses[idx].Set(progress)
+}
+
+// setFileSlots sets how many files download at once, with a title and progress bar shown for each.
+// Adaptive downloading can go up to its maximum, so there's a slot for each of those instead.
+func setFileSlots(state *InstallerState, workers int) {
+	state.workers = workers
+	slots := workers
+	if state.adaptive.Enabled {
+		slots = state.adaptive.Max
+	}
+	state.fileTitles = make([]binding.String, slots)
+	state.fileProgresses = make([]binding.Float, slots)
+	for i := 0; i < slots; i++ {
+		state.fileTitles[i] = binding.NewString()
+		_ = state.fileTitles[i].Set("None")
+		state.fileProgresses[i] = binding.NewFloat()
+	}
+	_ = state.workersEntry.Set(strconv.Itoa(workers))
+	if state.adaptive.Enabled {
+		workers = state.adaptive.Clamp(workers)
+	}
+	_ = state.formatWorkers.Set(state.adaptive.Describe(workers))
+}
+
+// setProgressBindings updates the total progress labels and bar
+func setProgressBindings(state *InstallerState, p DownloadProgress) {
+	_ = state.formatDownloadedFiles.Set(humanize.Comma(p.DownloadedFiles))
+	_ = state.formatDownloadedSize.Set(FormatBytes(p.DownloadedSize))
+	_ = state.formatTotalFiles.Set(humanize.Comma(p.TotalFiles))
+	_ = state.formatTotalSize.Set(FormatBytes(p.TotalSize))
+	_ = state.progressBarTotal.Set(p.Fraction())
+}
+
+// promptRemoveDroppedFiles offers to delete files left over from the previous version, if there are any
+func promptRemoveDroppedFiles(state *InstallerState) {
+	if state.Repo == nil {
+		return
+	}
+	count, size, err := state.Repo.GetRemovedFilesSummary()
+	if err != nil {
+		dialog.NewError(&DatabaseError{err}, state.window).Show()
+		return
+	}
+	if count == 0 {
+		return
+	}
+	paths, err := state.Repo.GetRemovedFiles()
+	if err != nil {
+		dialog.NewError(&DatabaseError{err}, state.window).Show()
+		return
+	}
+
+	pathList := widget.NewList(
+		func() int {
+			return len(paths)
+		},
+		func() fyne.CanvasObject {
+			label := widget.NewLabel("")
+			label.Wrapping = fyne.TextTruncate
+			return label
+		},
+		func(id widget.ListItemID, item fyne.CanvasObject) {
+			item.(*widget.Label).SetText(paths[id])
+		})
+	content := container.NewBorder(
+		widget.NewLabel(fmt.Sprintf("%s files (%s) are no longer part of this version. Remove them?", humanize.Comma(count), FormatBytes(size))),
+		nil, nil, nil,
+		container.NewGridWrap(fyne.Size{Width: 500, Height: 250}, pathList))
+
+	dialog.NewCustomConfirm("Remove Old Files", "Remove", "Keep", content, func(confirmed bool) {
+		if !confirmed {
+			err := state.Repo.ClearRemovedFiles()
+			if err != nil {
+				dialog.NewError(&DatabaseError{err}, state.window).Show()
+			}
+			return
+		}
+		installPath, err := state.folderPath.Get()
+		if err != nil {
+			dialog.NewError(err, state.window).Show()
+			return
+		}
+		removed, err := removeDroppedFiles(state.Repo, installPath)
+		if err != nil {
+			dialog.NewError(err, state.window).Show()
+			return
+		}
+		dialog.NewInformation("Old Files Removed", fmt.Sprintf("Removed %s old files", humanize.Comma(removed)), state.window).Show()
+	}, state.window).Show()
+}
+
+// promptContinuePastQuota explains why downloading stopped and offers to carry on regardless
+func promptContinuePastQuota(state *InstallerState, reached *QuotaReached) {
+	message := reached.Error() + ", downloading has been paused.\nContinue downloading anyway until the updater is closed?"
+	dialog.NewConfirm("Data Quota Reached", message, func(confirmed bool) {
+		if !confirmed || state.Grabber == nil {
+			return
+		}
+		state.Grabber.OverrideQuota()
+		err := state.Grabber.Resume()
+		if err != nil {
+			dialog.NewError(&FatalDownloadFailure{err}, state.window).Show()
+		}
+	}, state.window).Show()
+}
+
+// showFailures lists the files which ran out of retries, offering to download just those again
+func showFailures(state *InstallerState) {
+	if state.Repo == nil || state.Grabber == nil {
+		return
+	}
+	failures, err := state.Repo.GetFailures()
+	if err != nil {
+		dialog.NewError(&DatabaseError{err}, state.window).Show()
+		return
+	}
+	if len(failures) == 0 {
+		dialog.NewInformation("Failed Files", "No files have failed to download.", state.window).Show()
+		return
+	}
+
+	errorLabel := widget.NewLabel("")
+	errorLabel.Wrapping = fyne.TextWrapWord
+	failureList := widget.NewList(
+		func() int {
+			return len(failures)
+		},
+		func() fyne.CanvasObject {
+			label := widget.NewLabel("")
+			label.Wrapping = fyne.TextTruncate
+			return label
+		},
+		func(id widget.ListItemID, item fyne.CanvasObject) {
+			item.(*widget.Label).SetText(failures[id].String())
+		})
+	failureList.OnSelected = func(id widget.ListItemID) {
+		errorLabel.SetText(failures[id].Error)
+	}
+
+	var d dialog.Dialog
+	retryButton := widget.NewButton("Retry Failed Files", func() {
+		d.Hide()
+		err := state.Grabber.RetryFailed()
+		if err != nil {
+			var reached *QuotaReached
+			if errors.As(err, &reached) {
+				promptContinuePastQuota(state, reached)
+				return
+			}
+			dialog.NewError(&FatalDownloadFailure{err}, state.window).Show()
+		}
+	})
+	content := container.NewBorder(nil, container.NewVBox(errorLabel, retryButton), nil, nil,
+		container.NewGridWrap(fyne.Size{Width: 600, Height: 250}, failureList))
+	d = dialog.NewCustom(fmt.Sprintf("Failed Files (%s)", humanize.Comma(int64(len(failures)))), "Close", content, state.window)
+	d.Show()
+}
+
+// showMirrorStats opens a dialog listing how each mirror is performing, refreshed until closed
+func showMirrorStats(state *InstallerState) {
+	if state.Grabber == nil {
+		return
+	}
+	// Swapped in by the refresh below while the list reads it
+	stats := state.Grabber.MirrorStats()
+	statsMu := sync.Mutex{}
+	statsList := widget.NewList(
+		func() int {
+			statsMu.Lock()
+			defer statsMu.Unlock()
+			return len(stats)
+		},
+		func() fyne.CanvasObject {
+			label := widget.NewLabel("")
+			label.Wrapping = fyne.TextTruncate
+			return label
+		},
+		func(id widget.ListItemID, item fyne.CanvasObject) {
+			statsMu.Lock()
+			defer statsMu.Unlock()
+			if id < len(stats) {
+				item.(*widget.Label).SetText(stats[id].String())
+			}
+		})
+
+	done := make(chan struct{})
+	d := dialog.NewCustom("Mirrors", "Close", container.NewGridWrap(fyne.Size{Width: 600, Height: 200}, statsList), state.window)
+	d.SetOnClosed(func() {
+		close(done)
+	})
+	go func() {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				latest := state.Grabber.MirrorStats()
+				statsMu.Lock()
+				stats = latest
+				statsMu.Unlock()
+				statsList.Refresh()
+			}
+		}
+	}()
+	d.Show()
+}
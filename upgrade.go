@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stashIndex moves an existing index aside so a new one can be downloaded and compared against it.
+// Returns the path of the stashed index, or an empty string if there is no previous index.
+func stashIndex(folderPath string) (string, error) {
+	dbPath := filepath.Join(folderPath, "ultimate.sqlite")
+	previousPath := filepath.Join(folderPath, "ultimate-previous.sqlite")
+
+	_, err := os.Stat(dbPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		// No current index, but keep any left behind by an interrupted upgrade
+		_, err = os.Stat(previousPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return "", nil
+			}
+			return "", err
+		}
+		return previousPath, nil
+	}
+
+	err = renameDatabase(dbPath, previousPath)
+	if err != nil {
+		return "", err
+	}
+	return previousPath, nil
+}
+
+// restoreIndex moves a stashed index back into place after a failed upgrade
+func restoreIndex(folderPath string, previousPath string) error {
+	if previousPath == "" {
+		return nil
+	}
+	return renameDatabase(previousPath, filepath.Join(folderPath, "ultimate.sqlite"))
+}
+
+// carryOverProgress marks every file in the new index that is unchanged from the stashed index, and was
+// already downloaded, as done. Unfinished downloads of changed files are deleted so they aren't resumed with the
+// old contents, and files dropped from the new index are recorded for removeDroppedFiles.
+// This month's data usage is kept, and the stashed index is removed afterwards. Returns the number of files carried over.
+func carryOverProgress(folderPath string, previousPath string) (int64, error) {
+	repo, err := OpenDatabase(filepath.Join(folderPath, "ultimate.sqlite"))
+	if err != nil {
+		return 0, err
+	}
+	defer repo.Close()
+
+	changed, err := repo.GetChangedFiles(previousPath)
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range changed {
+		// The installed copy is kept until the new one has downloaded and passed its checksum
+		err = os.Remove(partialPath(folderPath, p))
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+
+	count, err := repo.MarkUnchangedDone(previousPath)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = repo.RecordRemovedFiles(previousPath)
+	if err != nil {
+		return 0, err
+	}
+
+	// Data used this month belongs to the install, not the index
+	err = repo.CopyState(previousPath, quotaMonthKey, quotaMonthBytesKey)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, removeDatabase(previousPath)
+}
+
+// removeDroppedFiles deletes files recorded as dropped by the last upgrade, along with any folders left empty.
+// Folders listed as empty dirs in the current index are kept. Returns the number of files deleted.
+func removeDroppedFiles(repo *SqliteRepo, installPath string) (int64, error) {
+	paths, err := repo.GetRemovedFiles()
+	if err != nil {
+		return 0, err
+	}
+	emptyDirs, err := repo.GetEmptyDirs()
+	if err != nil {
+		return 0, err
+	}
+	root, err := filepath.Abs(installPath)
+	if err != nil {
+		return 0, err
+	}
+	keep := make(map[string]bool)
+	for _, d := range emptyDirs {
+		keep[filepath.Join(root, d)] = true
+	}
+
+	removed := int64(0)
+	for _, p := range paths {
+		// Never trust a path from the index to stay inside the install
+		dest := filepath.Join(root, p)
+		if !strings.HasPrefix(dest, root+string(filepath.Separator)) {
+			continue
+		}
+		info, err := os.Lstat(dest)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return removed, err
+		}
+		if info.IsDir() {
+			// Now a folder in the new version, which is left alone
+			continue
+		}
+		err = os.Remove(dest)
+		if err != nil {
+			return removed, err
+		}
+		removed += 1
+
+		// Walk up removing folders until one is still in use
+		dir := filepath.Dir(dest)
+		for dir != root && len(dir) > len(root) && !keep[dir] {
+			if os.Remove(dir) != nil {
+				// Not empty, or otherwise in use
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+	}
+
+	return removed, repo.ClearRemovedFiles()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// writePreviousIndex creates an index at p as an earlier version of the install would have left it,
+// with the given paths already downloaded
+func writePreviousIndex(t *testing.T, p string, files []*IndexedFile, done ...string) {
+	t.Helper()
+	writeIndex(t, p, "http://localhost", files...)
+	repo, err := OpenDatabase(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	for _, path := range done {
+		_, err = repo.db.Exec("UPDATE files SET done = true WHERE path = ?", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRemoveDroppedFiles(t *testing.T) {
+	dir := t.TempDir()
+	installPath := filepath.Join(dir, "install")
+	previousPath := filepath.Join(dir, "previous.sqlite")
+	writePreviousIndex(t, previousPath, []*IndexedFile{
+		testFile("Data/Foo.swf", []byte("old")),
+		testFile("Data/gone.bin", []byte("dropped")),
+		testFile("Data/now-folder", []byte("was a file")),
+		testFile("../outside.txt", []byte("not ours")),
+	})
+	repo := openTestIndex(t, "http://localhost",
+		testFile("Data/foo.swf", []byte("new")),
+		testFile("Data/now-folder/inner.bin", []byte("inner")))
+
+	_, err := repo.RecordRemovedFiles(previousPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := repo.GetRemovedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only changing case isn't a drop
+	want := []string{"../outside.txt", "Data/gone.bin", "Data/now-folder"}
+	sort.Strings(recorded)
+	if len(recorded) != len(want) {
+		t.Fatalf("recorded %v as dropped, want %v", recorded, want)
+	}
+	for i := range want {
+		if recorded[i] != want[i] {
+			t.Fatalf("recorded %v as dropped, want %v", recorded, want)
+		}
+	}
+
+	writeInstalled(t, installPath, "Data/foo.swf", []byte("new"))
+	writeInstalled(t, installPath, "Data/gone.bin", []byte("dropped"))
+	writeInstalled(t, installPath, "Data/now-folder/inner.bin", []byte("inner"))
+	writeInstalled(t, dir, "outside.txt", []byte("not ours"))
+
+	removed, err := removeDroppedFiles(repo, installPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("removed %d files, want 1", removed)
+	}
+	tests := []struct {
+		path   string
+		exists bool
+	}{
+		{filepath.Join(installPath, "Data/gone.bin"), false},
+		{filepath.Join(installPath, "Data/foo.swf"), true},
+		{filepath.Join(installPath, "Data/now-folder/inner.bin"), true},
+		{filepath.Join(dir, "outside.txt"), true},
+	}
+	for _, test := range tests {
+		_, err := os.Stat(test.path)
+		if exists := err == nil; exists != test.exists {
+			t.Errorf("%s exists = %t, want %t", test.path, exists, test.exists)
+		}
+	}
+	left, err := repo.GetRemovedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("%v still recorded after removing", left)
+	}
+}
+
+func TestCarryOverProgress(t *testing.T) {
+	folderPath := t.TempDir()
+	previousPath := filepath.Join(folderPath, "ultimate-previous.sqlite")
+	writePreviousIndex(t, previousPath, []*IndexedFile{
+		{Filepath: "Data/same.bin", Size: 10, CRC32: 1},
+		{Filepath: "Data/not-yet.bin", Size: 10, CRC32: 2},
+		{Filepath: "Data/new-crc.bin", Size: 10, CRC32: 3},
+		{Filepath: "Data/new-size.bin", Size: 10, CRC32: 4},
+		{Filepath: "Data/dropped.bin", Size: 10, CRC32: 5},
+	}, "Data/same.bin", "Data/new-crc.bin", "Data/new-size.bin", "Data/dropped.bin")
+	writeIndex(t, filepath.Join(folderPath, "ultimate.sqlite"), "http://localhost",
+		&IndexedFile{Filepath: "Data/same.bin", Size: 10, CRC32: 1},
+		&IndexedFile{Filepath: "Data/not-yet.bin", Size: 10, CRC32: 2},
+		&IndexedFile{Filepath: "Data/new-crc.bin", Size: 10, CRC32: 33},
+		&IndexedFile{Filepath: "Data/new-size.bin", Size: 20, CRC32: 4},
+		&IndexedFile{Filepath: "Data/added.bin", Size: 10, CRC32: 6})
+	// An unfinished download of the old contents, and the installed copy which must stay until replaced
+	writeInstalled(t, folderPath, filepath.Join(partialDir, "Data/new-crc.bin"), []byte("old partial"))
+	writeInstalled(t, folderPath, "Data/new-crc.bin", []byte("old version"))
+
+	count, err := carryOverProgress(folderPath, previousPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("carried over %d files, want 1", count)
+	}
+	if _, err := os.Stat(previousPath); !os.IsNotExist(err) {
+		t.Errorf("previous index not removed: %v", err)
+	}
+	if _, err := os.Stat(partialPath(folderPath, "Data/new-crc.bin")); !os.IsNotExist(err) {
+		t.Errorf("partial download of the old contents kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(folderPath, "Data/new-crc.bin")); err != nil {
+		t.Errorf("installed copy of a changed file removed before its replacement downloaded: %v", err)
+	}
+
+	repo, err := OpenDatabase(filepath.Join(folderPath, "ultimate.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	tests := []struct {
+		path   string
+		queued bool
+	}{
+		{"Data/same.bin", false},
+		{"Data/not-yet.bin", true},
+		{"Data/new-crc.bin", true},
+		{"Data/new-size.bin", true},
+		{"Data/added.bin", true},
+	}
+	for _, test := range tests {
+		if got := isQueued(t, repo, test.path); got != test.queued {
+			t.Errorf("%s queued = %t, want %t", test.path, got, test.queued)
+		}
+	}
+	removed, err := repo.GetRemovedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != "Data/dropped.bin" {
+		t.Errorf("recorded %v as dropped, want only Data/dropped.bin", removed)
+	}
+}